@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The admin API is for operators and is only served when ADMIN_TOKEN is
+// set. Requests carry the token as "Authorization: Bearer <token>" and are
+// rate-limited per IP, wrong token or not, so it cannot be guessed quickly.
+
+const (
+	// adminRequestsPerMinute is how many admin requests one IP may make.
+	adminRequestsPerMinute = 10
+	// maxAnnouncementLength is the longest announcement accepted, in
+	// characters.
+	maxAnnouncementLength = 500
+)
+
+// requireAdmin rejects requests without the admin token.
+func (s *Server) requireAdmin(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+		slog.Warn("Rejected admin request", "path", c.Request.URL.Path, "clientIp", c.ClientIP())
+		abortError(c, http.StatusUnauthorized, "Admin token required")
+		return
+	}
+	c.Next()
+}
+
+// handleAnnounce sends an announcement to every client in every room and
+// reports how many it reached.
+func (s *Server) handleAnnounce(c *gin.Context) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		respondError(c, http.StatusBadRequest, "Announcement text is required")
+		return
+	}
+	if utf8.RuneCountInString(text) > maxAnnouncementLength {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Announcement is longer than %d characters", maxAnnouncementLength))
+		return
+	}
+
+	reached := s.hub.announce(text)
+	slog.Info("Sent announcement", "clients", reached)
+	c.JSON(http.StatusOK, gin.H{"clients": reached})
+}
+
+// announce queues an announcement for every connected client and returns
+// how many there were. Detached clients have no connection to send to and
+// are not counted.
+func (h *Hub) announce(text string) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	reached := 0
+	for _, room := range h.rooms {
+		reached += room.Broadcast(Message{
+			Type:      MessageAnnouncement,
+			RoomID:    room.ID,
+			Text:      text,
+			Timestamp: serverNow(),
+		}, nil)
+		messagesRelayed.WithLabelValues(MessageAnnouncement).Inc()
+	}
+	return reached
+}
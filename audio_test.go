@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioServesByteRanges(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000f1"
+	audio := make([]byte, 1000)
+	for i := range audio {
+		audio[i] = byte(i)
+	}
+	if err := os.WriteFile(filepath.Join(h.config.UploadDir, roomID+".mp3"), audio, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/audio-sync/audio/"+roomID, nil)
+	req.Header.Set("Range", "bytes=100-200")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 100-200/1000" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 100-200/1000")
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", got)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want audio/mpeg", got)
+	}
+	if !bytes.Equal(body, audio[100:201]) {
+		t.Errorf("body is %d bytes, not bytes 100-200 of the file", len(body))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// A track can vanish from storage behind the server's back, deleted by an
+// operator or a bucket lifecycle rule. Listeners would then just see their
+// player fail, so the server tells them instead with audio_unavailable,
+// once per track. It finds out in two ways: deletes made through storage
+// are reported as they happen, and the current track of every room with
+// clients is checked for on a timer, which catches everything else.
+
+// audioCheckInterval is how often the current tracks of occupied rooms are
+// checked for. With S3 each check is one HEAD request per room.
+const audioCheckInterval = time.Minute
+
+// deleteHookStorage is a Storage that calls onDelete after each successful
+// Delete. newHub wraps the configured storage in it.
+type deleteHookStorage struct {
+	Storage
+	onDelete func(name string)
+}
+
+func (s deleteHookStorage) Delete(name string) error {
+	if err := s.Storage.Delete(name); err != nil {
+		return err
+	}
+	// Some deletes are made with the hub lock held, as the janitor's are,
+	// and reporting needs that lock too.
+	go s.onDelete(name)
+	return nil
+}
+
+// trackDeleted tells the room name belongs to, if it is live and the track
+// is in its playlist, that the track is gone.
+func (h *Hub) trackDeleted(name string) {
+	roomID, ok := uploadRoomID(name)
+	if !ok {
+		return
+	}
+	if room, exists := h.lookupRoom(roomID); exists {
+		reportUnavailable(room, name)
+	}
+}
+
+// runAudioCheck checks the rooms' current tracks every interval. It never
+// returns.
+func runAudioCheck(hub *Hub, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hub.checkRoomAudio()
+	}
+}
+
+// checkRoomAudio reports the current track of each occupied room if it has
+// disappeared from storage.
+func (h *Hub) checkRoomAudio() {
+	for _, room := range h.snapshot() {
+		room.mutex.RLock()
+		name := ""
+		if len(room.Clients) > 0 && room.CurrentTrack < len(room.Playlist) {
+			name = room.Playlist[room.CurrentTrack].Filename
+		}
+		room.mutex.RUnlock()
+		if name == "" {
+			continue
+		}
+
+		_, err := h.storage.Stat(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			reportUnavailable(room, name)
+		case err != nil:
+			slog.Warn("Failed to check track", "roomId", room.ID, "track", name, "error", err)
+		default:
+			// Put back under the same name, say by an operator restoring
+			// it, the track may be reported again if it goes again.
+			room.mutex.Lock()
+			delete(room.unavailable, name)
+			room.mutex.Unlock()
+		}
+	}
+}
+
+// reportUnavailable tells the room that the track stored as name is gone,
+// unless it has been told already or the track is not in its playlist.
+func reportUnavailable(room *Room, name string) {
+	room.mutex.Lock()
+	index := -1
+	for i, track := range room.Playlist {
+		if track.Filename == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 || room.unavailable[name] || room.Closed {
+		room.mutex.Unlock()
+		return
+	}
+	if room.unavailable == nil {
+		room.unavailable = make(map[string]bool)
+	}
+	room.unavailable[name] = true
+	room.mutex.Unlock()
+
+	slog.Warn("Track is no longer in storage", "roomId", room.ID, "track", name)
+	broadcast(room, Message{
+		Type:   MessageAudioUnavailable,
+		RoomID: room.ID,
+		Track:  index,
+		Error:  "this track is no longer available",
+	})
+}
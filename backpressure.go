@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A client that cannot keep up shows first as a send queue that stays near
+// full and then, once the queue overflows, as dropped messages and a
+// disconnect. Both are exported as metrics, and writePump warns when a
+// queue has been near full for a while, so operators can tell why a
+// listener fell out of sync before it was dropped.
+//
+// A client whose socket stops draining altogether would block writePump in
+// a write, with the queue filling behind it. Every write has a deadline of
+// WS_WRITE_TIMEOUT instead, and a client that misses it is disconnected.
+
+const (
+	// sendQueueHighWater is the queue length considered near full.
+	sendQueueHighWater = sendBufferSize * 3 / 4
+	// slowClientWarnAfter is how long a queue must stay near full before
+	// the client is logged as falling behind.
+	slowClientWarnAfter = 5 * time.Second
+)
+
+// writeStats records how a connection's writes have gone. Only writePump
+// touches it, except for dropped, which Send increments.
+type writeStats struct {
+	writes  int64
+	total   time.Duration
+	max     time.Duration
+	dropped atomic.Int64
+
+	// nearFullSince is when the queue last reached sendQueueHighWater, or
+	// zero while it is below. warned is set once the episode is logged.
+	nearFullSince time.Time
+	warned        bool
+}
+
+func (s *writeStats) recordWrite(d time.Duration) {
+	s.writes++
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+	wsWriteDuration.Observe(d.Seconds())
+}
+
+func (s *writeStats) average() time.Duration {
+	if s.writes == 0 {
+		return 0
+	}
+	return s.total / time.Duration(s.writes)
+}
+
+// recordDrop counts a message Send could not queue.
+func (c *Client) recordDrop() {
+	c.stats.dropped.Add(1)
+	wsMessagesDropped.Inc()
+}
+
+// checkSendQueue logs a warning, once per episode, when the client's send
+// queue has stayed near full for slowClientWarnAfter.
+func (c *Client) checkSendQueue(now time.Time) {
+	s := &c.stats
+	queued := len(c.send)
+	if queued < sendQueueHighWater {
+		s.nearFullSince = time.Time{}
+		s.warned = false
+		return
+	}
+	if s.nearFullSince.IsZero() {
+		s.nearFullSince = now
+		return
+	}
+	if !s.warned && now.Sub(s.nearFullSince) >= slowClientWarnAfter {
+		s.warned = true
+		c.logger.Warn("Client is falling behind",
+			"queued", queued,
+			"capacity", sendBufferSize,
+			"nearFullMs", now.Sub(s.nearFullSince).Milliseconds(),
+			"avgWriteMs", s.average().Milliseconds(),
+			"maxWriteMs", s.max.Milliseconds(),
+		)
+	}
+}
+
+// writeFailed logs a failed write and closes the connection, which the
+// client's read loop then reports as a drop. A write that hit its deadline
+// means the client's socket has stopped draining, so it is counted as such
+// and, like a client that is too slow, may not resume its session.
+func (c *Client) writeFailed(msg string, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.serverClosed.Store(true)
+		wsWriteTimeouts.Inc()
+		c.logger.Warn("WebSocket write timed out, disconnecting client", "timeout", c.writeTimeout.String())
+	} else {
+		c.logger.Warn(msg, "error", err)
+	}
+	c.conn.Close()
+}
+
+// logWriteStats logs the connection's write statistics once writePump is
+// done with it.
+func (c *Client) logWriteStats() {
+	s := &c.stats
+	c.logger.Debug("WebSocket write stats",
+		"writes", s.writes,
+		"avgWriteMs", s.average().Milliseconds(),
+		"maxWriteMs", s.max.Milliseconds(),
+		"dropped", s.dropped.Load(),
+	)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// A client that negotiates audio-sync.v1.binary instead of audio-sync.v1
+// is sent sync pulses, the one message every client gets every few seconds
+// for as long as a room plays, as binary frames in the fixed layout below.
+// Everything else, including the sync_state and control messages that also
+// carry a position, stays JSON text, as does everything clients send. A
+// JSON pulse runs to around 140 bytes, most of them field names and the
+// room ID the connection already implies; the binary one is
+// pulseFrameSize. The bytes saved are counted in
+// audiosync_ws_pulse_bytes_saved_total.
+//
+// All fields are big-endian:
+//
+//	offset  size  field
+//	0       1     frame kind, 1 for sync_pulse
+//	1       1     flags, bit 0 set while playing
+//	2       4     track, unsigned
+//	6       8     seq, unsigned
+//	14      8     time, IEEE 754 double, in seconds
+//	22      8     serverTime, signed, in epoch milliseconds
+//
+// A client should ignore frames of a kind it does not know, so that others
+// can be added without a new protocol version.
+
+// protocolV1Binary is protocolV1 with binary sync pulses.
+const protocolV1Binary = "audio-sync.v1.binary"
+
+const (
+	// binarySyncPulse is the frame kind of a sync pulse.
+	binarySyncPulse byte = 1
+	// pulseFrameSize is the length of a binary sync pulse.
+	pulseFrameSize = 30
+	// pulsePlaying is the flag set in a pulse while the room plays.
+	pulsePlaying byte = 1 << 0
+)
+
+// sendsBinary reports whether msg goes to client as a binary frame.
+func (c *Client) sendsBinary(msg *Message) bool {
+	return c.binaryPulses && msg.Type == MessageSyncPulse
+}
+
+// encodeBinaryPulse lays out the sync pulse msg as a binary frame.
+func encodeBinaryPulse(msg *Message) []byte {
+	frame := make([]byte, pulseFrameSize)
+	frame[0] = binarySyncPulse
+	if msg.IsPlaying {
+		frame[1] |= pulsePlaying
+	}
+	binary.BigEndian.PutUint32(frame[2:], uint32(msg.Track))
+	binary.BigEndian.PutUint64(frame[6:], msg.Seq)
+	binary.BigEndian.PutUint64(frame[14:], math.Float64bits(*msg.Time))
+	binary.BigEndian.PutUint64(frame[22:], uint64(msg.ServerTime))
+	return frame
+}
@@ -0,0 +1,37 @@
+package main
+
+// Everything the server sends to a whole room goes through Room.Broadcast,
+// which decides who gets it under one read lock: everyone in the room but
+// the excepted client, less clients that have stopped following for
+// playback messages and dropped clients waiting to resume, whose queues
+// nobody is draining. Client.Send never blocks, so sending under the lock
+// is safe; a client whose queue is full is marked slow there and dropped by
+// its writePump.
+
+// Broadcast queues msg for everyone in the room but except, which may be
+// nil, and wakes the room's event streams. It returns how many clients msg
+// was queued for.
+func (r *Room) Broadcast(msg Message, except *Client) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.broadcastLocked(msg, except)
+}
+
+// broadcastLocked is Broadcast for callers already holding r.mutex, for
+// reading at least.
+func (r *Room) broadcastLocked(msg Message, except *Client) int {
+	notifySubscribers(r, &msg)
+	sent := 0
+	for client := range r.Clients {
+		if client == except || skipsMessage(client, msg.Type) {
+			continue
+		}
+		if d, ok := r.detached[client.session]; ok && d.client == client {
+			continue
+		}
+		client.Send(msg)
+		sent++
+	}
+	r.fanout.count(sent)
+	return sent
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxChatLength is the longest chat message accepted, in characters.
+	maxChatLength = 500
+	// chatMessagesPerMinute is how many chat messages one connection may
+	// send per minute, after an initial burst of the same size.
+	chatMessagesPerMinute = 20
+	// chatHistorySize is how many recent chat messages a room keeps to
+	// show newcomers.
+	chatHistorySize = 50
+)
+
+// handleChat rate-limits a chat message from sender, stamps it with the
+// sender and server time and relays it.
+func handleChat(room *Room, sender *Client, msg *Message) error {
+	text := strings.TrimSpace(msg.Text)
+	if ok, _ := room.hub.chatLimiter.allow(sender.ID); !ok {
+		return fmt.Errorf("sending chat messages too quickly")
+	}
+
+	*msg = Message{
+		Type:      MessageChat,
+		RoomID:    room.ID,
+		Sender:    sender.ID,
+		Text:      text,
+		Timestamp: serverNow(),
+	}
+
+	room.mutex.Lock()
+	room.ChatHistory = append(room.ChatHistory, *msg)
+	if len(room.ChatHistory) > chatHistorySize {
+		room.ChatHistory = room.ChatHistory[len(room.ChatHistory)-chatHistorySize:]
+	}
+	room.mutex.Unlock()
+
+	relay(room, sender, msg)
+	return nil
+}
+
+// sendChatHistory gives a newly joined client the room's recent chat.
+func sendChatHistory(room *Room, client *Client) {
+	room.mutex.RLock()
+	history := append([]Message(nil), room.ChatHistory...)
+	room.mutex.RUnlock()
+
+	if len(history) == 0 {
+		return
+	}
+	client.Send(Message{
+		Type:     MessageChatHistory,
+		RoomID:   room.ID,
+		Messages: history,
+	})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Chunked uploads let flaky clients resume a large upload instead of starting
+// over. The protocol is:
+//
+//	POST /upload/init                  {"filename": "song.mp3"} -> {"uploadId"}
+//	PUT  /upload/:uploadId/chunk/:n    raw bytes of chunk n, starting at 0
+//	GET  /upload/:uploadId             -> {"receivedChunks", "sizeBytes"}
+//	POST /upload/:uploadId/complete    -> {"roomId"}
+//
+// Each chunk is stored as its own file, so re-sending a chunk after a failure
+// simply replaces it. Complete requires chunks 0..n-1 with no gaps, joins
+// them in order and validates the result like a regular upload. It takes the
+// same roomId, private, password and name form fields as a regular upload,
+// and the host key to append to a room.
+
+const (
+	// uploadIDBytes is the number of random bytes in an upload ID.
+	uploadIDBytes = 16
+	// maxChunks bounds how many chunks a single upload may have.
+	maxChunks = 10000
+	// chunkedUploadTTL is how long an upload may go without a new chunk
+	// before the janitor discards it.
+	chunkedUploadTTL = time.Hour
+)
+
+type chunkedUpload struct {
+	ID         string
+	Filename   string
+	Chunks     map[int]int64 // chunk index -> size
+	LastActive time.Time
+
+	// dir is the upload's subdirectory of chunkedUploads.dir.
+	dir string
+}
+
+// size returns the total bytes received so far. The caller must hold
+// the chunkedUploads mutex.
+func (u *chunkedUpload) size() int64 {
+	var total int64
+	for _, n := range u.Chunks {
+		total += n
+	}
+	return total
+}
+
+// chunkedUploads are the uploads in progress, by ID. dir holds their chunks,
+// one subdirectory per upload.
+type chunkedUploads struct {
+	dir     string
+	uploads map[string]*chunkedUpload
+	mutex   sync.Mutex
+}
+
+func newChunkedUploads(uploadDir string) *chunkedUploads {
+	return &chunkedUploads{
+		dir:     filepath.Join(uploadDir, ".chunks"),
+		uploads: make(map[string]*chunkedUpload),
+	}
+}
+
+func (s *Server) lookupChunkedUpload(c *gin.Context) (*chunkedUpload, bool) {
+	uploadID := c.Param("uploadId")
+	if !isHexID(uploadID, uploadIDBytes) {
+		respondError(c, http.StatusBadRequest, "Invalid upload ID")
+		return nil, false
+	}
+
+	s.chunked.mutex.Lock()
+	upload, exists := s.chunked.uploads[uploadID]
+	s.chunked.mutex.Unlock()
+
+	if !exists {
+		respondError(c, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	return upload, true
+}
+
+func (s *Server) handleChunkedUploadInit(c *gin.Context) {
+	var req struct {
+		Filename string `json:"filename"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Filename == "" {
+		respondError(c, http.StatusBadRequest, "filename is required")
+		return
+	}
+
+	// Without an accepted extension the format is sniffed once the upload
+	// is complete, so only a name that can never pass is turned away now.
+	if len(req.Filename) > maxUploadFilenameBytes {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Filenames must be at most %d bytes", maxUploadFilenameBytes))
+		return
+	}
+
+	upload := &chunkedUpload{
+		ID:         generateHexID(uploadIDBytes),
+		Filename:   req.Filename,
+		Chunks:     make(map[int]int64),
+		LastActive: time.Now(),
+	}
+	upload.dir = filepath.Join(s.chunked.dir, upload.ID)
+	if !s.requireUploadDir(c) {
+		return
+	}
+	if err := os.MkdirAll(upload.dir, 0755); err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to start upload")
+		return
+	}
+
+	s.chunked.mutex.Lock()
+	s.chunked.uploads[upload.ID] = upload
+	s.chunked.mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"uploadId": upload.ID})
+}
+
+func (s *Server) handleChunkedUploadStatus(c *gin.Context) {
+	upload, ok := s.lookupChunkedUpload(c)
+	if !ok {
+		return
+	}
+
+	s.chunked.mutex.Lock()
+	received := make([]int, 0, len(upload.Chunks))
+	for n := range upload.Chunks {
+		received = append(received, n)
+	}
+	size := upload.size()
+	s.chunked.mutex.Unlock()
+
+	sort.Ints(received)
+	c.JSON(http.StatusOK, gin.H{
+		"receivedChunks": received,
+		"sizeBytes":      size,
+	})
+}
+
+func (s *Server) handleChunkedUploadChunk(c *gin.Context) {
+	upload, ok := s.lookupChunkedUpload(c)
+	if !ok {
+		return
+	}
+
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 0 || n >= maxChunks {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Chunk index must be between 0 and %d", maxChunks-1))
+		return
+	}
+
+	// Write to a temporary name first so a failed or oversized chunk never
+	// replaces a good copy from an earlier attempt.
+	if !s.requireDiskSpace(c, c.Request.ContentLength) {
+		return
+	}
+	chunkPath := filepath.Join(upload.dir, strconv.Itoa(n))
+	tmpPath := chunkPath + ".part"
+	written, err := saveChunk(tmpPath, http.MaxBytesReader(c.Writer, c.Request.Body, s.config.MaxUploadBytes))
+	if err != nil {
+		os.Remove(tmpPath)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, maximum size is %d bytes", s.config.MaxUploadBytes))
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "Failed to save chunk")
+		return
+	}
+
+	s.chunked.mutex.Lock()
+	defer s.chunked.mutex.Unlock()
+
+	if s.chunked.uploads[upload.ID] != upload {
+		// Completed or expired while this chunk was in flight.
+		os.Remove(tmpPath)
+		respondError(c, http.StatusNotFound, "Upload not found")
+		return
+	}
+	if upload.size()-upload.Chunks[n]+written > s.config.MaxUploadBytes {
+		os.Remove(tmpPath)
+		respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, maximum size is %d bytes", s.config.MaxUploadBytes))
+		return
+	}
+	if err := os.Rename(tmpPath, chunkPath); err != nil {
+		os.Remove(tmpPath)
+		respondError(c, http.StatusInternalServerError, "Failed to save chunk")
+		return
+	}
+
+	upload.Chunks[n] = written
+	upload.LastActive = time.Now()
+
+	c.JSON(http.StatusOK, gin.H{
+		"chunk":     n,
+		"sizeBytes": written,
+	})
+}
+
+func saveChunk(path string, r io.Reader) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+func (s *Server) handleChunkedUploadComplete(c *gin.Context) {
+	upload, ok := s.lookupChunkedUpload(c)
+	if !ok {
+		return
+	}
+	// Checked before the upload is consumed, so the client can retry.
+	target, ok := s.requireUploadTarget(c)
+	if !ok {
+		return
+	}
+	s.chunked.mutex.Lock()
+	need := upload.size()
+	s.chunked.mutex.Unlock()
+	if s.config.Storage == "local" {
+		// The assembled file is copied into storage beside it.
+		need *= 2
+	}
+	if !s.requireDiskSpace(c, need) {
+		return
+	}
+
+	// Take the upload out of the table up front so concurrent chunks and a
+	// second complete cannot touch it while it is being assembled.
+	s.chunked.mutex.Lock()
+	if s.chunked.uploads[upload.ID] != upload {
+		s.chunked.mutex.Unlock()
+		respondError(c, http.StatusNotFound, "Upload not found")
+		return
+	}
+	count := len(upload.Chunks)
+	for n := 0; n < count; n++ {
+		if _, ok := upload.Chunks[n]; !ok {
+			s.chunked.mutex.Unlock()
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Missing chunk %d", n))
+			return
+		}
+	}
+	if count == 0 {
+		s.chunked.mutex.Unlock()
+		respondError(c, http.StatusBadRequest, "No chunks uploaded")
+		return
+	}
+	size := upload.size()
+	delete(s.chunked.uploads, upload.ID)
+	s.chunked.mutex.Unlock()
+
+	defer os.RemoveAll(upload.dir)
+
+	assembled := filepath.Join(upload.dir, "assembled")
+	if err := assembleChunks(assembled, upload.dir, count); err != nil {
+		slog.Error("Failed to assemble upload", "uploadId", upload.ID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	f, err := os.Open(assembled)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+	ext, probed, ok := s.requireValidUpload(c, f, size, upload.Filename)
+	f.Close()
+	if !ok {
+		return
+	}
+
+	s.hub.playlistMu.Lock()
+	next, ok := s.uploadTrackIndex(c, target)
+	if !ok {
+		s.hub.playlistMu.Unlock()
+		return
+	}
+	filename := trackFilename(target.roomID, next, ext)
+	sum, err := s.hub.saveAssembledTrack(assembled, filename)
+	if err != nil {
+		s.hub.playlistMu.Unlock()
+		slog.Error("Failed to save upload", "uploadId", upload.ID, "track", filename, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	md := labelAudio(probed, filename, upload.Filename)
+	md.SHA256 = sum
+	if err := s.hub.saveAudioMetadata(filename, md); err != nil {
+		slog.Error("Failed to save metadata", "track", filename, "error", err)
+	}
+	s.hub.playlistMu.Unlock()
+
+	s.finishUpload(c, target, []Track{{Index: next, Filename: filename, AudioMetadata: md}}, size)
+}
+
+// saveAssembledTrack copies the assembled upload, or any other local file, at
+// path into storage as name, returning its SHA-256.
+func (h *Hub) saveAssembledTrack(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return h.saveHashed(name, f)
+}
+
+// assembleChunks concatenates chunks 0..count-1 from dir into dst.
+func assembleChunks(dst, dir string, count int) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for n := 0; n < count; n++ {
+		in, err := os.Open(filepath.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// cleanupStale discards uploads that have not received a chunk within ttl,
+// along with any chunk directories left behind by a restart.
+func (u *chunkedUploads) cleanupStale(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for id, upload := range u.uploads {
+		if upload.LastActive.Before(cutoff) {
+			delete(u.uploads, id)
+			os.RemoveAll(upload.dir)
+			slog.Info("Janitor removed abandoned upload", "uploadId", id)
+		}
+	}
+
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, active := u.uploads[entry.Name()]; active {
+			continue
+		}
+		// Skip directories an in-flight complete is still assembling.
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		os.RemoveAll(filepath.Join(u.dir, entry.Name()))
+	}
+}
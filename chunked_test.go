@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// startChunkedUpload sends data as a one-chunk upload and returns its ID.
+func startChunkedUpload(t *testing.T, srv *httptest.Server, filename string, data []byte) string {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/audio-sync/upload/init", "application/json", strings.NewReader(`{"filename":"`+filename+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var init struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&init); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/audio-sync/upload/"+init.UploadID+"/chunk/0", bytes.NewReader(data))
+	chunk, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk.Body.Close()
+	if chunk.StatusCode != http.StatusOK {
+		t.Fatalf("chunk: status = %d, want %d", chunk.StatusCode, http.StatusOK)
+	}
+	return init.UploadID
+}
+
+// completeChunkedUpload completes an upload with the given form fields and
+// host key, if any.
+func completeChunkedUpload(t *testing.T, srv *httptest.Server, uploadID string, fields url.Values, key string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/audio-sync/upload/"+uploadID+"/complete", strings.NewReader(fields.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestChunkedUploadTakesRegularUploadOptions(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+
+	id := startChunkedUpload(t, srv, "one.wav", testWAV(1))
+	resp := completeChunkedUpload(t, srv, id, url.Values{
+		"private":  {"true"},
+		"password": {"hunter22"},
+		"name":     {"Friday mix"},
+	}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("complete: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var created struct {
+		RoomID    string `json:"roomId"`
+		JoinToken string `json:"joinToken"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.JoinToken == "" || h.loadTokenHash(created.RoomID) == nil {
+		t.Error("private upload has no join token")
+	}
+	if h.loadPasswordHash(created.RoomID) == nil {
+		t.Error("room password was not set")
+	}
+	if name := h.loadRoomName(created.RoomID); name != "Friday mix" {
+		t.Errorf("room name = %q, want %q", name, "Friday mix")
+	}
+}
+
+func TestChunkedUploadAppendsWithHostKey(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+
+	var created uploadResponse
+	if err := json.NewDecoder(postUpload(t, srv, nil, map[string][]byte{"one.wav": testWAV(1)}).Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	host := dialRoom(t, srv, created.RoomID)
+	hostKey := host.expect(MessageHostChanged).HostKey
+
+	id := startChunkedUpload(t, srv, "two.wav", testWAV(1))
+	fields := url.Values{"roomId": {created.RoomID}}
+	if resp := completeChunkedUpload(t, srv, id, fields, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("append without host key: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	// The rejected complete leaves the upload to be retried.
+	if resp := completeChunkedUpload(t, srv, id, fields, hostKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("append with host key: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	room, _ := h.lookupRoom(created.RoomID)
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	if len(room.Playlist) != 2 || room.Playlist[1].Index != 1 || room.Playlist[1].OriginalFilename != "two.wav" {
+		t.Errorf("playlist = %+v, want two.wav appended as track 1", room.Playlist)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A clip is a segment of one of a room's tracks, cut out by ffmpeg and put
+// in a room of its own, so that a listener can share just that part. The
+// segment keeps the track's format and is stream copied rather than
+// re-encoded, so an MP3 clip starts and ends on the nearest frame. From
+// there on the clip is an upload like any other: it is stored, probed and
+// transcoded in the same way, and the response has the same shape.
+//
+// Clipping needs ffmpeg on the PATH, but not TRANSCODE.
+
+const (
+	// clipTimeout bounds a single ffmpeg run, including the wait for a
+	// free transcode slot.
+	clipTimeout = 2 * time.Minute
+	// minClipSeconds is the shortest clip that can be made.
+	minClipSeconds = 0.1
+)
+
+func (s *Server) handleClip(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+
+	var req struct {
+		Track        int      `json:"track"`
+		StartSeconds *float64 `json:"startSeconds"`
+		EndSeconds   *float64 `json:"endSeconds"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.StartSeconds == nil || req.EndSeconds == nil {
+		respondError(c, http.StatusBadRequest, "startSeconds and endSeconds are required")
+		return
+	}
+	start, end := *req.StartSeconds, *req.EndSeconds
+	if start < 0 || end-start < minClipSeconds {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("endSeconds must be at least %g after startSeconds, which must not be negative", minClipSeconds))
+		return
+	}
+
+	name, ok := s.hub.findTrackAudio(roomID, req.Track)
+	if !ok {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+	if isRemoteTrack(name) {
+		respondError(c, http.StatusBadRequest, "Remote tracks cannot be clipped")
+		return
+	}
+	source := s.hub.loadAudioMetadata(name)
+	if source.Duration > 0 && end > source.Duration {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("endSeconds is past the end of the track, which is %.3f seconds long", source.Duration))
+		return
+	}
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		respondError(c, http.StatusNotImplemented, "Clipping is not available on this server")
+		return
+	}
+	if !s.requireUploadDir(c) || !s.requireRoomCapacity(c) {
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	clipPath, err := s.hub.cutClip(c.Request.Context(), ffmpeg, name, ext, start, end)
+	if err != nil {
+		slog.Error("Failed to clip track", "roomId", roomID, "track", name, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to clip track")
+		return
+	}
+	defer os.Remove(clipPath)
+	info, err := os.Stat(clipPath)
+	if err != nil || info.Size() == 0 {
+		slog.Error("ffmpeg produced no clip", "roomId", roomID, "track", name, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to clip track")
+		return
+	}
+
+	clipRoomID, err := s.hub.generateRoomID()
+	if err != nil {
+		slog.Error("Failed to generate room ID", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to create room")
+		return
+	}
+	filename := trackFilename(clipRoomID, 0, ext)
+	sum, err := s.hub.saveAssembledTrack(clipPath, filename)
+	if err != nil {
+		slog.Error("Failed to save clip", "roomId", clipRoomID, "track", filename, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	md := s.hub.probeAudioMetadata(filename, source.OriginalFilename)
+	md.SHA256 = sum
+	// The cut drops most tags, so the clip is labelled like its track.
+	md.Title = source.Title
+	if md.Artist == "" {
+		md.Artist = source.Artist
+	}
+	if err := s.hub.saveAudioMetadata(filename, md); err != nil {
+		slog.Error("Failed to save metadata", "track", filename, "error", err)
+	}
+	s.hub.transcodeInBackground(filename)
+
+	tracks := []Track{{Index: 0, Filename: filename, AudioMetadata: md}}
+	resp := gin.H{
+		"roomId":  clipRoomID,
+		"tracks":  tracks,
+		"message": "Clip created successfully",
+	}
+	describeUpload(c, resp, clipRoomID, "", tracks, info.Size())
+
+	slog.Info("Clip created", "roomId", roomID, "track", name, "clipRoomId", clipRoomID,
+		"startSeconds", start, "endSeconds", end, "clientIp", c.ClientIP())
+	c.JSON(http.StatusOK, resp)
+}
+
+// cutClip has ffmpeg copy start to end seconds of the track stored as name
+// into a temporary file with extension ext, whose path it returns. It takes
+// one of the transcode slots, so clips and transcodes share the limit on
+// concurrent ffmpeg processes.
+func (h *Hub) cutClip(ctx context.Context, ffmpeg, name, ext string, start, end float64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clipTimeout)
+	defer cancel()
+
+	select {
+	case h.transcodeSlots <- struct{}{}:
+		defer func() { <-h.transcodeSlots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	src, _, err := h.storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "audio-sync-clip-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-nostdin", "-loglevel", "error", "-y",
+		"-i", "pipe:0",
+		"-ss", formatSeconds(start), "-to", formatSeconds(end),
+		"-vn", "-codec:a", "copy",
+		tmp.Name(),
+	)
+	cmd.Stdin = src
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return tmp.Name(), nil
+}
+
+// formatSeconds writes a position the way ffmpeg's -ss and -to take it.
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clockBase anchors serverNow. Adding the monotonic time elapsed since then
+// to its wall-clock reading yields timestamps that never jump, even if the
+// system clock is adjusted while the server is running.
+var clockBase = time.Now()
+
+// serverNow returns the server's current time in Unix epoch milliseconds.
+func serverNow() int64 {
+	return clockBase.Add(time.Since(clockBase)).UnixMilli()
+}
+
+// handleTime returns the server clock so clients can estimate their offset
+// from it. A client records its own time t0 before the request and t1 after
+// the response, then assumes the server read its clock halfway through:
+//
+//	offset = serverTime - (t0 + t1) / 2
+//
+// This holds when the request and response legs take equally long; an
+// asymmetric network skews the offset by half the difference. Taking the
+// sample with the smallest round trip out of several keeps the error small.
+// Playback messages carry serverTime, so with the offset a client can tell
+// how long ago, on its own clock, the state was current.
+func handleTime(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"serverTime": serverNow()})
+}
+
+// The same estimate can be made over the room WebSocket, without the extra
+// HTTP requests. The client sends
+//
+//	{"type": "ping_time", "clientTime": t0}
+//
+// with t0 read from its own clock in milliseconds, and the server answers
+//
+//	{"type": "pong_time", "clientTime": t0, "serverTime": ts}
+//
+// echoing t0 so that the client need not match replies to requests. With
+// t1 the time the reply arrives, the round trip is t1 - t0 and the offset,
+// as above, serverTime - (t0 + t1) / 2. ts is read when the ping is
+// handled, so time the reply then spends in the client's send queue counts
+// against the return leg; on a quiet connection that is negligible, and on
+// a busy one the sample has a longer round trip and loses to a better one.
+// A client should send a few pings a moment apart and keep the sample with
+// the shortest round trip, as it would with /api/time.
+
+// handlePingTime answers a ping_time with the server's clock.
+func handlePingTime(room *Room, sender *Client, msg *Message) error {
+	sender.Send(Message{
+		Type:       MessagePongTime,
+		RoomID:     room.ID,
+		ClientTime: msg.ClientTime,
+		ServerTime: serverNow(),
+	})
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// When the server closes a WebSocket itself, the close frame says why in a
+// way clients can act on. The code identifies the cause and the reason text
+// starts with a short name for it, optionally followed by a retry hint:
+//
+//	<name> [retry=<seconds>]
+//
+// A hint is the number of seconds to wait before reconnecting, since doing
+// so sooner would be turned away again. Without one, reconnecting on its own
+// is pointless and the client should wait for its user.
+//
+//	1001 going_away       retry=5   the server is shutting down or restarting
+//	4001 room_full        retry=15  the room has MAX_CLIENTS_PER_ROOM clients
+//	4002 idle_timeout               sent nothing for IDLE_TIMEOUT
+//	4003 server_full      retry=60  the server has MAX_ROOMS rooms
+//	4004 kicked                     removed by the host
+//	4005 room_closed                the host deleted the room
+//	4006 client_too_slow  retry=1   fell too far behind on messages
+//	4007 unsupported_protocol       offered no protocol version the server speaks
+//	4008 rate_limited     retry=5   kept sending past WS_MESSAGES_PER_SECOND
+//
+// Codes 4000 to 4999 are the range RFC 6455 leaves to applications. Any
+// other code, or a connection lost without a close frame, is an ordinary
+// drop, which the client may retry at once, resuming its session.
+
+// closeReason is one entry in the close code contract.
+type closeReason struct {
+	code  int
+	name  string
+	retry time.Duration
+}
+
+var (
+	closeGoingAway  = closeReason{websocket.CloseGoingAway, "going_away", 5 * time.Second}
+	closeRoomFull   = closeReason{4001, MessageRoomFull, 15 * time.Second}
+	closeIdle       = closeReason{4002, MessageIdleTimeout, 0}
+	closeServerFull = closeReason{4003, MessageServerFull, time.Minute}
+	closeKicked     = closeReason{4004, "kicked", 0}
+	closeRoomClosed = closeReason{4005, "room_closed", 0}
+	closeTooSlow    = closeReason{4006, "client_too_slow", time.Second}
+
+	closeUnsupportedProtocol = closeReason{4007, "unsupported_protocol", 0}
+	closeRateLimited         = closeReason{4008, "rate_limited", 5 * time.Second}
+)
+
+// text is the reason sent in the close frame.
+func (r closeReason) text() string {
+	if r.retry <= 0 {
+		return r.name
+	}
+	return r.name + " retry=" + strconv.Itoa(int(r.retry/time.Second))
+}
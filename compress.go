@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With AUDIO_GZIP set, uncompressed formats are gzipped for clients that
+// accept it. The compressed formats (MP3, Ogg, FLAC, AAC) would gain
+// nothing and are always sent as stored.
+//
+// Range requests are served uncompressed. The ranges a browser asks for
+// while seeking are offsets into the file, and answering them from a gzip
+// stream would mean compressing from the start every time; the ranges in
+// a response would also have to be offsets into the compressed stream,
+// which a player cannot map to a position. So gzip is only used for whole
+// file GETs, and since the two kinds of response differ, both carry
+// Vary: Accept-Encoding.
+
+// gzipAudioFormats are the extensions worth compressing.
+var gzipAudioFormats = map[string]bool{
+	".wav": true,
+}
+
+// shouldGzipAudio reports whether the response for a track with extension
+// ext should be gzipped. It adds Vary: Accept-Encoding for any track that
+// may be.
+func (s *Server) shouldGzipAudio(c *gin.Context, ext string) bool {
+	if !s.config.GzipAudio || !gzipAudioFormats[ext] {
+		return false
+	}
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	return c.Request.Method == http.MethodGet &&
+		c.GetHeader("Range") == "" &&
+		acceptsGzip(c.GetHeader("Accept-Encoding"))
+}
+
+// acceptsGzip reports whether an Accept-Encoding header gives gzip, directly
+// or through "*", a q value above zero.
+func acceptsGzip(header string) bool {
+	q, specific := 0.0, false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && (coding != "*" || specific) {
+			continue
+		}
+		v := 1.0
+		if raw, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				v = parsed
+			}
+		}
+		q, specific = v, coding == "gzip"
+	}
+	return q > 0
+}
+
+// gzipResponseWriter compresses a successful response. Others, such as a
+// 304 from http.ServeContent, are passed through as they are, since they
+// have no body for it to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", "gzip")
+		w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.BestSpeed)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+// Close finishes the gzip stream, if the response is compressed.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
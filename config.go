@@ -0,0 +1,243 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPort      = 8080
+	defaultUploadDir = "uploads"
+	defaultStaticDir = "static"
+	// defaultMaxUploadBytes caps the size of one upload.
+	defaultMaxUploadBytes int64 = 50 << 20
+	// defaultMaxAudioDuration caps the length of one uploaded track.
+	defaultMaxAudioDuration = 2 * time.Hour
+	// defaultMaxClientsPerRoom caps how many connections a room accepts.
+	defaultMaxClientsPerRoom = 50
+	// defaultMaxRooms caps how many rooms the server holds at once.
+	defaultMaxRooms = 5000
+	// defaultRoomTTL is how long a room may sit without clients before the
+	// janitor removes it and its audio.
+	defaultRoomTTL = 2 * time.Hour
+	// defaultWSBufferSize is the upgrader's read and write buffer size, the
+	// same as net/http's own buffers that gorilla/websocket otherwise reuses.
+	defaultWSBufferSize = 4 << 10
+	// defaultMaxMessageBytes caps one message from a client. The largest
+	// legitimate one is a chat message, which stays under 2KB.
+	defaultMaxMessageBytes int64 = 8 << 10
+
+	defaultS3Region = "us-east-1"
+)
+
+// Config holds the settings that differ between deployments. Each field is
+// read from the environment variable named in its comment.
+type Config struct {
+	Port              int           // PORT
+	UploadDir         string        // UPLOAD_DIR
+	StaticDir         string        // STATIC_DIR, the pages and assets served to browsers
+	MaxUploadBytes    int64         // MAX_UPLOAD_BYTES
+	MaxAudioDuration  time.Duration // MAX_AUDIO_DURATION, e.g. "3h", for the formats probed
+	MaxClientsPerRoom int           // MAX_CLIENTS_PER_ROOM
+	MaxRooms          int           // MAX_ROOMS, live rooms the server holds at once
+	RoomTTL           time.Duration // ROOM_TTL, e.g. "90m"
+	UploadsPerMinute  int           // UPLOADS_PER_MINUTE, per client IP
+	MaxUploads        int           // MAX_CONCURRENT_UPLOADS, processed at once; see uploadgate.go
+	UploadQueueWait   time.Duration // UPLOAD_QUEUE_WAIT, how long an upload waits for a slot; zero rejects
+	SyncPulseInterval time.Duration // SYNC_PULSE_INTERVAL, e.g. "5s"
+	Compression       bool          // WS_COMPRESSION, "true" to offer permessage-deflate
+	Transcode         bool          // TRANSCODE, "true" to convert uploads to MP3 with ffmpeg
+	GzipAudio         bool          // AUDIO_GZIP, "true" to gzip whole-file WAV responses
+	SessionGrace      time.Duration // SESSION_GRACE, how long a dropped client may resume
+	SeekThrottle      time.Duration // SEEK_THROTTLE, minimum gap between relayed seeks
+	WSReadBufferSize  int           // WS_READ_BUFFER_SIZE, in bytes
+	WSWriteBufferSize int           // WS_WRITE_BUFFER_SIZE, in bytes
+	MaxMessageBytes   int64         // WS_MAX_MESSAGE_BYTES, larger messages disconnect the client
+	WSWriteTimeout    time.Duration // WS_WRITE_TIMEOUT, slower writes disconnect the client
+	WSMessageRate     int           // WS_MESSAGES_PER_SECOND, per connection; see msgrate.go
+	IdleTimeout       time.Duration // IDLE_TIMEOUT, disconnects silent non-hosts; zero disables
+	PlaceholderAudio  string        // PLACEHOLDER_AUDIO, a local file served for rooms without tracks
+
+	// AllowedOrigins lists the origins permitted to open WebSockets, from
+	// the comma-separated ALLOWED_ORIGINS. Empty, or containing "*",
+	// allows all.
+	AllowedOrigins []string
+
+	// CORSMethods and CORSHeaders are the methods and request headers
+	// allowed in cross-origin API calls, from the comma-separated
+	// CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS.
+	CORSMethods string
+	CORSHeaders string
+
+	// TrustedProxies lists the IPs and CIDR ranges of reverse proxies, from
+	// the comma-separated TRUSTED_PROXIES. Only requests arriving from one
+	// of them have their client IP taken from X-Forwarded-For or X-Real-IP;
+	// anyone else could put whatever they like in those headers, dodging
+	// rate limits and forging logs. Empty trusts no proxy and uses the
+	// connection's address.
+	TrustedProxies []string
+
+	// AdminToken authorizes the admin API, from ADMIN_TOKEN. Empty turns
+	// the admin API off.
+	AdminToken string
+
+	// RoomStorePath is the file rooms are persisted to, from
+	// ROOM_STORE_PATH. Empty keeps rooms in memory only.
+	RoomStorePath string
+
+	// Storage is where tracks are kept, from STORAGE: "local" for the
+	// uploads directory or "s3" for the bucket described by S3.
+	Storage string
+	S3      S3Config
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:              defaultPort,
+		UploadDir:         defaultUploadDir,
+		StaticDir:         defaultStaticDir,
+		MaxUploadBytes:    defaultMaxUploadBytes,
+		MaxAudioDuration:  defaultMaxAudioDuration,
+		MaxClientsPerRoom: defaultMaxClientsPerRoom,
+		MaxRooms:          defaultMaxRooms,
+		RoomTTL:           defaultRoomTTL,
+		UploadsPerMinute:  defaultUploadsPerMinute,
+		MaxUploads:        defaultMaxUploads,
+		SyncPulseInterval: defaultSyncPulseInterval,
+		SessionGrace:      defaultSessionGrace,
+		SeekThrottle:      defaultSeekThrottle,
+		CORSMethods:       defaultCORSMethods,
+		CORSHeaders:       defaultCORSHeaders,
+		WSReadBufferSize:  defaultWSBufferSize,
+		WSWriteBufferSize: defaultWSBufferSize,
+		MaxMessageBytes:   defaultMaxMessageBytes,
+		WSWriteTimeout:    defaultWriteTimeout,
+		WSMessageRate:     defaultWSMessageRate,
+		Storage:           "local",
+		S3:                S3Config{Region: defaultS3Region},
+	}
+}
+
+// loadConfig reads the configuration from the environment, keeping the
+// default for anything unset or malformed.
+func loadConfig() Config {
+	cfg := defaultConfig()
+	cfg.Port = int(envInt64("PORT", int64(cfg.Port)))
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		cfg.UploadDir = dir
+	}
+	if dir := os.Getenv("STATIC_DIR"); dir != "" {
+		cfg.StaticDir = dir
+	}
+	cfg.MaxUploadBytes = envInt64("MAX_UPLOAD_BYTES", cfg.MaxUploadBytes)
+	cfg.MaxAudioDuration = envDuration("MAX_AUDIO_DURATION", cfg.MaxAudioDuration)
+	cfg.MaxClientsPerRoom = int(envInt64("MAX_CLIENTS_PER_ROOM", int64(cfg.MaxClientsPerRoom)))
+	cfg.MaxRooms = int(envInt64("MAX_ROOMS", int64(cfg.MaxRooms)))
+	cfg.RoomTTL = envDuration("ROOM_TTL", cfg.RoomTTL)
+	cfg.UploadsPerMinute = int(envInt64("UPLOADS_PER_MINUTE", int64(cfg.UploadsPerMinute)))
+	cfg.MaxUploads = int(envInt64("MAX_CONCURRENT_UPLOADS", int64(cfg.MaxUploads)))
+	cfg.UploadQueueWait = envDuration("UPLOAD_QUEUE_WAIT", cfg.UploadQueueWait)
+	cfg.SyncPulseInterval = envDuration("SYNC_PULSE_INTERVAL", cfg.SyncPulseInterval)
+	cfg.Compression = envBool("WS_COMPRESSION", cfg.Compression)
+	cfg.Transcode = envBool("TRANSCODE", cfg.Transcode)
+	cfg.GzipAudio = envBool("AUDIO_GZIP", cfg.GzipAudio)
+	cfg.SessionGrace = envDuration("SESSION_GRACE", cfg.SessionGrace)
+	cfg.SeekThrottle = envDuration("SEEK_THROTTLE", cfg.SeekThrottle)
+	cfg.WSReadBufferSize = int(envInt64("WS_READ_BUFFER_SIZE", int64(cfg.WSReadBufferSize)))
+	cfg.WSWriteBufferSize = int(envInt64("WS_WRITE_BUFFER_SIZE", int64(cfg.WSWriteBufferSize)))
+	cfg.MaxMessageBytes = envInt64("WS_MAX_MESSAGE_BYTES", cfg.MaxMessageBytes)
+	cfg.WSWriteTimeout = envDuration("WS_WRITE_TIMEOUT", cfg.WSWriteTimeout)
+	cfg.WSMessageRate = int(envInt64("WS_MESSAGES_PER_SECOND", int64(cfg.WSMessageRate)))
+	cfg.IdleTimeout = envDuration("IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.PlaceholderAudio = os.Getenv("PLACEHOLDER_AUDIO")
+	cfg.AllowedOrigins = parseOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	if methods := os.Getenv("CORS_ALLOWED_METHODS"); methods != "" {
+		cfg.CORSMethods = methods
+	}
+	if headers := os.Getenv("CORS_ALLOWED_HEADERS"); headers != "" {
+		cfg.CORSHeaders = headers
+	}
+	cfg.TrustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.RoomStorePath = os.Getenv("ROOM_STORE_PATH")
+	if backend := os.Getenv("STORAGE"); backend != "" {
+		cfg.Storage = backend
+	}
+	cfg.S3.Bucket = os.Getenv("S3_BUCKET")
+	if region := os.Getenv("S3_REGION"); region != "" {
+		cfg.S3.Region = region
+	}
+	cfg.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.S3.Prefix = os.Getenv("S3_PREFIX")
+	cfg.S3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	cfg.S3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	cfg.S3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	return cfg
+}
+
+// envInt64 reads a positive integer from the environment, falling back to def
+// when the variable is unset or malformed.
+func envInt64(name string, def int64) int64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v <= 0 {
+		slog.Warn("Ignoring invalid environment variable", "name", name, "value", raw, "default", def)
+		return def
+	}
+	return v
+}
+
+// envDuration reads a positive Go duration (e.g. "90m") from the
+// environment, falling back to def when the variable is unset or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil || v <= 0 {
+		slog.Warn("Ignoring invalid environment variable", "name", name, "value", raw, "default", def.String())
+		return def
+	}
+	return v
+}
+
+// parseTrustedProxies splits a comma-separated list of IPs and CIDR ranges,
+// warning about and skipping anything that is neither.
+func parseTrustedProxies(raw string) []string {
+	var proxies []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			slog.Warn("Ignoring invalid trusted proxy", "name", "TRUSTED_PROXIES", "value", entry)
+			continue
+		}
+		proxies = append(proxies, entry)
+	}
+	return proxies
+}
+
+// envBool reads a boolean ("true", "false", "1", "0", ...) from the
+// environment, falling back to def when the variable is unset or malformed.
+func envBool(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		slog.Warn("Ignoring invalid environment variable", "name", name, "value", raw, "default", def)
+		return def
+	}
+	return v
+}
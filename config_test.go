@@ -0,0 +1,17 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	got := parseTrustedProxies(" 10.0.0.1, 192.168.0.0/16,not-an-ip,, 2001:db8::/32 ,300.1.1.1")
+	want := []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseTrustedProxies = %q, want %q", got, want)
+	}
+	if got := parseTrustedProxies(""); len(got) != 0 {
+		t.Errorf("parseTrustedProxies(\"\") = %q, want none", got)
+	}
+}
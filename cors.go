@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The REST API can be called from front-ends served from another origin.
+// Which origins may do so is ALLOWED_ORIGINS, the same list that guards
+// WebSockets, so that an empty list allows everyone in development and a
+// production deployment names its front-ends once.
+
+const (
+	defaultCORSMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	defaultCORSHeaders = "Authorization, Content-Type"
+	// corsMaxAge is how long, in seconds, browsers may cache a preflight.
+	corsMaxAge = "600"
+)
+
+// corsMiddleware adds CORS headers to requests for paths under one of
+// prefixes and answers their preflight requests. It is installed on the
+// router rather than on routes because preflights use OPTIONS, which no
+// route is registered for.
+func (s *Server) corsMiddleware(prefixes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || !hasAnyPrefix(c.Request.URL.Path, prefixes) {
+			c.Next()
+			return
+		}
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		c.Header("Vary", "Origin")
+		if !s.config.originAllowed(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			// Without the headers the browser keeps the response from
+			// the page.
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", s.config.CORSMethods)
+			c.Header("Access-Control-Allow-Headers", s.config.CORSHeaders)
+			c.Header("Access-Control-Max-Age", corsMaxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
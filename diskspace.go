@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A write that runs out of disk space fails partway, after the client has
+// sent everything, and can leave a truncated file behind. Uploads are
+// checked against the free space in the uploads directory before anything
+// is written, using the size the client declares, and turned away with a
+// 507 if it would not fit with diskSpaceReserve to spare. The check is a
+// preflight, not a reservation: concurrent uploads can still fill the disk
+// between it and the write, which then fails as it always has.
+//
+// Where the free space cannot be measured, on platforms without statfs or
+// when the directory is unreadable, uploads go ahead unchecked.
+
+// diskSpaceReserve is the free space left over for the sidecars and
+// everything else that writes to the disk.
+const diskSpaceReserve = 16 << 20
+
+// requireDiskSpace responds 507 and returns false if the uploads directory
+// does not have room for need more bytes. A need of 0 or less, as for a
+// request with no Content-Length, only checks the reserve.
+func (s *Server) requireDiskSpace(c *gin.Context, need int64) bool {
+	available, err := availableDiskBytes(s.config.UploadDir)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			slog.Warn("Could not check free disk space", "path", s.config.UploadDir, "error", err)
+		}
+		return true
+	}
+	if need < 0 {
+		need = 0
+	}
+	if available >= uint64(need)+diskSpaceReserve {
+		return true
+	}
+	slog.Error("Rejected upload, disk is nearly full", "path", s.config.UploadDir, "availableBytes", available, "neededBytes", need)
+	respondError(c, http.StatusInsufficientStorage, "Insufficient storage for this upload, try again later")
+	return false
+}
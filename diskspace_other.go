@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// availableDiskBytes cannot measure free space on this platform.
+func availableDiskBytes(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /audio/:id/download serves a track as an attachment named after the file
+// the uploader chose, or its title, rather than the room ID it is stored
+// under. It is always the file as uploaded, never a transcoded copy, since
+// a download is meant to keep rather than to play in the page.
+
+// handleAudioDownload serves the track from /audio/:id/download or
+// /audio/:id/:trackIndex/download with a Content-Disposition naming it.
+func (s *Server) handleAudioDownload(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+
+	index := 0
+	if raw := c.Param("trackIndex"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			respondError(c, http.StatusBadRequest, "Invalid track index")
+			return
+		}
+		index = n
+	}
+
+	name, ok := s.hub.findTrackAudio(roomID, index)
+	if !ok {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+	if isRemoteTrack(name) {
+		respondError(c, http.StatusBadRequest, "Remote tracks cannot be downloaded, fetch them from their own URL")
+		return
+	}
+
+	c.Header("Content-Disposition", attachmentDisposition(downloadFilename(name, s.hub.loadAudioMetadata(name))))
+	s.serveAudioFile(c, name)
+}
+
+// downloadFilename names the track stored as name for saving: its original
+// filename, else its title, else the stored name, always with the extension
+// of the stored file.
+func downloadFilename(name string, md AudioMetadata) string {
+	ext := filepath.Ext(name)
+	for _, candidate := range []string{md.OriginalFilename, md.Title} {
+		// Only the last path element of an uploaded filename, and none of
+		// the characters that would make it unsafe to save as is.
+		base := candidate[strings.LastIndexAny(candidate, `/\`)+1:]
+		base = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || strings.ContainsRune(`"*:<>?|`, r) {
+				return -1
+			}
+			return r
+		}, base)
+		base = strings.TrimSpace(strings.TrimSuffix(base, filepath.Ext(base)))
+		if base != "" && base != "." && base != ".." {
+			return base + ext
+		}
+	}
+	return name
+}
+
+// attachmentDisposition is a Content-Disposition header saving the response
+// as filename. mime encodes names that are not plain ASCII as RFC 2231
+// filename*, which every current browser understands.
+func attachmentDisposition(filename string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return "attachment"
+}
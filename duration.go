@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Durations are read from headers where the format has them, rather than
+// by running the file through a decoder: an MP3's Xing, Info or VBRI header
+// counts its frames, and a WAV's chunks give the size of its samples and
+// how many bytes of them make a second. Both are found within the first few
+// kilobytes, so even a long upload is probed at once. An MP3 without such a
+// header, as constant bitrate files from older encoders are, and a WAV
+// whose data size is unset, as a streamed recording's can be, fall back to
+// the decoders in metadata.go.
+
+// mp3HeaderScan is how far into the audio, past any ID3v2 tag, the first
+// MP3 frame is looked for.
+const mp3HeaderScan = 8 << 10
+
+// mp3SampleRates are the sample rates of MPEG-1 layer III by header index.
+// MPEG-2 halves them and MPEG-2.5 quarters them.
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+// mp3HeaderDuration reads an MP3's duration from the Xing, Info or VBRI
+// header in its first frame, skipping any ID3v2 tag before it. It reports
+// false if the file has no such header.
+func mp3HeaderDuration(r io.ReadSeeker) (float64, bool) {
+	var tag [10]byte
+	if _, err := io.ReadFull(r, tag[:]); err != nil {
+		return 0, false
+	}
+	start := int64(0)
+	if string(tag[:3]) == "ID3" {
+		// The tag's size is syncsafe, seven bits to a byte, and leaves out
+		// the header and any footer.
+		size := int64(tag[6]&0x7f)<<21 | int64(tag[7]&0x7f)<<14 | int64(tag[8]&0x7f)<<7 | int64(tag[9]&0x7f)
+		start = 10 + size
+		if tag[5]&0x10 != 0 {
+			start += 10
+		}
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0, false
+	}
+
+	buf := make([]byte, mp3HeaderScan)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, false
+	}
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		frames, sampleRate, samples, ok := mp3FrameCount(buf[i:])
+		if ok {
+			return float64(frames) * float64(samples) / float64(sampleRate), true
+		}
+		if sampleRate > 0 {
+			// The first frame, without a header to count with.
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// mp3FrameCount parses the layer III frame header at the start of frame and
+// returns the frame count from the Xing, Info or VBRI header that follows
+// it, along with the sample rate and samples per frame. sampleRate is zero
+// if frame does not start with a valid header.
+func mp3FrameCount(frame []byte) (frames uint32, sampleRate, samples int, ok bool) {
+	version := frame[1] >> 3 & 3 // 0 MPEG-2.5, 2 MPEG-2, 3 MPEG-1
+	layer := frame[1] >> 1 & 3   // 1 is layer III
+	bitrate := frame[2] >> 4
+	rateIndex := frame[2] >> 2 & 3
+	if version == 1 || layer != 1 || bitrate == 0 || bitrate == 15 || rateIndex == 3 {
+		return 0, 0, 0, false
+	}
+	mono := frame[3]>>6 == 3
+
+	sampleRate = mp3SampleRates[rateIndex]
+	samples = 1152
+	sideInfo := 32
+	switch {
+	case version == 3 && mono:
+		sideInfo = 17
+	case version != 3:
+		sampleRate /= 2
+		if version == 0 {
+			sampleRate /= 2
+		}
+		samples = 576
+		sideInfo = 17
+		if mono {
+			sideInfo = 9
+		}
+	}
+
+	if xing := frame[min(4+sideInfo, len(frame)):]; len(xing) >= 12 {
+		if id := string(xing[:4]); id == "Xing" || id == "Info" {
+			if binary.BigEndian.Uint32(xing[4:8])&1 != 0 {
+				frames = binary.BigEndian.Uint32(xing[8:12])
+			}
+			return frames, sampleRate, samples, frames > 0
+		}
+	}
+	if vbri := frame[min(36, len(frame)):]; len(vbri) >= 18 && string(vbri[:4]) == "VBRI" {
+		frames = binary.BigEndian.Uint32(vbri[14:18])
+		return frames, sampleRate, samples, frames > 0
+	}
+	return 0, sampleRate, samples, false
+}
+
+// wavHeaderDuration reads a WAV's duration from its chunks: the size of the
+// data chunk over the byte rate in the fmt chunk. It reports false if
+// either is missing or unset.
+func wavHeaderDuration(r io.ReadSeeker) (float64, bool) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return 0, false
+	}
+
+	var byteRate uint32
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, false
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch string(chunk[:4]) {
+		case "fmt ":
+			var format [16]byte
+			if size < int64(len(format)) {
+				return 0, false
+			}
+			if _, err := io.ReadFull(r, format[:]); err != nil {
+				return 0, false
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:12])
+			size -= int64(len(format))
+		case "data":
+			if byteRate == 0 || size == 0 || size == 0xFFFFFFFF {
+				return 0, false
+			}
+			return float64(size) / float64(byteRate), true
+		}
+		// Chunks are padded to an even size.
+		if _, err := r.Seek(size+size&1, io.SeekCurrent); err != nil {
+			return 0, false
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every HTTP error is returned as {"error": message, "code": code}. The
+// message is for people and may change; code is derived from the status,
+// e.g. "not_found", and is what API clients should match on.
+
+// errorCode is the stable code for an HTTP status.
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
+
+func errorBody(status int, msg string) gin.H {
+	return gin.H{"error": msg, "code": errorCode(status)}
+}
+
+// respondError writes an error response in the standard shape.
+func respondError(c *gin.Context, status int, msg string) {
+	c.JSON(status, errorBody(status, msg))
+}
+
+// abortError is respondError for middleware, also stopping the handler
+// chain.
+func abortError(c *gin.Context, status int, msg string) {
+	c.AbortWithStatusJSON(status, errorBody(status, msg))
+}
+
+// handleNoRoute serves index.html for paths a front-end router may own and
+// 404s everything else.
+func (s *Server) handleNoRoute(c *gin.Context) {
+	if isClientRoute(c.Request) {
+		c.File(filepath.Join(s.config.StaticDir, "index.html"))
+		return
+	}
+	respondError(c, http.StatusNotFound, "Not found")
+}
+
+// serverSegments are path segments that belong to the server's own
+// endpoints, under which a client route never lives.
+var serverSegments = map[string]bool{
+	"api":    true,
+	"ws":     true,
+	"audio":  true,
+	"upload": true,
+	"static": true,
+	"admin":  true,
+}
+
+// isClientRoute reports whether r looks like a page of a single-page front
+// end: a GET or HEAD outside the server's endpoints whose last segment has
+// no file extension, so that a missing script or image is still a 404.
+func isClientRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, segment := range segments {
+		if serverSegments[segment] {
+			return false
+		}
+	}
+	return path.Ext(segments[len(segments)-1]) == ""
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Integrations that only watch a room, such as a status dashboard, can read
+// its playback state over plain HTTP: once from /api/room/:id/state, or as
+// a stream of Server-Sent Events from /api/room/:id/events. A stream is
+// a read-only subscriber to the room's broadcasts. It is not a client, so it
+// neither counts towards the room's users nor keeps an empty room alive.
+// Each broadcast that changes the state only wakes the stream, which then
+// sends the state as it is by then, so a slow reader sees fewer, never
+// stale, events.
+
+// sseHeartbeat is how often an idle event stream is sent a comment, keeping
+// proxies from timing it out, and rechecks that its room still exists.
+const sseHeartbeat = 15 * time.Second
+
+// stateMessages are the broadcasts that change what PlaybackState reports.
+var stateMessages = map[string]bool{
+	MessagePlay:          true,
+	MessagePause:         true,
+	MessageSeek:          true,
+	MessageSeekingStart:  true,
+	MessageSeekingEnd:    true,
+	MessageNext:          true,
+	MessagePrev:          true,
+	MessageSelectTrack:   true,
+	MessagePlaybackEnded: true,
+	MessageStart:         true,
+	MessagePlaylist:      true,
+	MessageSyncPulse:     true,
+	MessageUserCount:     true,
+	MessageVolume:        true,
+	MessageMute:          true,
+}
+
+// PlaybackState is a room's authoritative playback state as served to
+// HTTP clients.
+type PlaybackState struct {
+	RoomID      string  `json:"roomId"`
+	Track       int     `json:"track"`
+	CurrentTime float64 `json:"currentTime"`
+	IsPlaying   bool    `json:"isPlaying"`
+	Seeking     bool    `json:"seeking"`
+	Volume      float64 `json:"volume"`
+	Muted       bool    `json:"muted"`
+	TrackCount  int     `json:"trackCount"`
+	UserCount   int     `json:"userCount"`
+	Seq         uint64  `json:"seq"`
+	ServerTime  int64   `json:"serverTime"`
+	// Placeholder is set when the room has no tracks and its audio URL
+	// serves PLACEHOLDER_AUDIO. See placeholder.go.
+	Placeholder bool `json:"placeholder,omitempty"`
+}
+
+// playbackState snapshots room's state. The caller must hold room.mutex.
+func playbackState(room *Room) PlaybackState {
+	return PlaybackState{
+		RoomID:      room.ID,
+		Track:       room.CurrentTrack,
+		CurrentTime: currentPosition(room),
+		IsPlaying:   room.IsPlaying,
+		Seeking:     room.Seeking,
+		Volume:      room.Volume,
+		Muted:       room.Muted,
+		TrackCount:  len(room.Playlist),
+		UserCount:   len(room.Clients),
+		Seq:         room.Seq,
+		ServerTime:  serverNow(),
+		Placeholder: len(room.Playlist) == 0 && room.hub.config.PlaceholderAudio != "",
+	}
+}
+
+// roomSubscriber is an event stream's registration with a room. changed
+// holds at most one pending wake-up.
+type roomSubscriber struct {
+	changed chan struct{}
+}
+
+// subscribe registers a new subscriber with the room.
+func subscribe(room *Room) *roomSubscriber {
+	sub := &roomSubscriber{changed: make(chan struct{}, 1)}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.subscribers == nil {
+		room.subscribers = make(map[*roomSubscriber]bool)
+	}
+	room.subscribers[sub] = true
+	return sub
+}
+
+func unsubscribe(room *Room, sub *roomSubscriber) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	delete(room.subscribers, sub)
+}
+
+// notifySubscribers wakes the room's event streams if msg changes the
+// state. The caller must hold room.mutex, for reading at least.
+func notifySubscribers(room *Room, msg *Message) {
+	if !stateMessages[msg.Type] {
+		return
+	}
+	for sub := range room.subscribers {
+		select {
+		case sub.changed <- struct{}{}:
+		default:
+			// Already woken; the state it sends will include this.
+		}
+	}
+}
+
+// closeEventStreams ends every event stream when the server shuts down, so
+// that http.Server.Shutdown does not wait for them.
+func (s *Server) closeEventStreams() {
+	s.closeStreams.Do(func() { close(s.streamsDone) })
+}
+
+// handleRoomState returns the room's playback state. A room that has audio
+// but that nobody has joined yet reports the state it will start in.
+func (s *Server) handleRoomState(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+
+	if room, exists := s.hub.lookupRoom(roomID); exists {
+		room.mutex.RLock()
+		state := playbackState(room)
+		room.mutex.RUnlock()
+		c.JSON(http.StatusOK, state)
+		return
+	}
+
+	playlist := s.hub.loadPlaylist(roomID)
+	if len(playlist) == 0 {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+	c.JSON(http.StatusOK, PlaybackState{RoomID: roomID, Volume: defaultVolume, TrackCount: len(playlist), ServerTime: serverNow()})
+}
+
+// handleRoomEvents streams the room's playback state as "state" events: one
+// on connecting and another after each change. The stream ends with a
+// "closed" event once the room is gone. Only live rooms can be followed.
+func (s *Server) handleRoomEvents(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+	room, exists := s.hub.lookupRoom(roomID)
+	if !exists {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	sub := subscribe(room)
+	defer unsubscribe(room, sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	c.Header("X-Accel-Buffering", "no")
+
+	sendState := func() {
+		room.mutex.RLock()
+		state := playbackState(room)
+		room.mutex.RUnlock()
+		c.SSEvent("state", state)
+		c.Writer.Flush()
+	}
+	sendState()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.streamsDone:
+			return
+		case <-sub.changed:
+			sendState()
+		case <-heartbeat.C:
+			if live, ok := s.hub.lookupRoom(roomID); !ok || live != room {
+				c.SSEvent("closed", gin.H{"roomId": roomID})
+				c.Writer.Flush()
+				return
+			}
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
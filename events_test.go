@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseEventStreamsEndsOnlyThatServersStreams(t *testing.T) {
+	h := newTestHub(t)
+	closing := newServer(h.config, h)
+	srv := httptest.NewServer(closing.newRouter())
+	t.Cleanup(srv.Close)
+	other := newServer(h.config, h)
+	roomID := "00000000000000c4"
+	dialRoom(t, srv, roomID).expectCount(1)
+
+	resp, err := http.Get(srv.URL + "/audio-sync/api/room/" + roomID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || !strings.HasPrefix(lines.Text(), "event:state") {
+		t.Fatalf("first line of the stream = %q, want a state event", lines.Text())
+	}
+
+	closing.closeEventStreams()
+	ended := make(chan struct{})
+	go func() {
+		for lines.Scan() {
+		}
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(testTimeout):
+		t.Fatal("event stream still open after closeEventStreams")
+	}
+	select {
+	case <-other.streamsDone:
+		t.Error("closing one server's streams closed another's")
+	default:
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "errors"
+
+// A listener can stop following the host to scrub through the track on its
+// own, and pick the room back up later. While it is not following, the
+// server leaves it out of the messages that would move its player: sync
+// pulses, the host's play, pause and seek, and ready checks and the starts
+// they lead to. Following again sends it a sync_state straight away.
+// Everyone else still reaches it: track changes, chat, the user list. Each
+// user_list says who is following, so the host can see who is in sync.
+
+// followedMessages are the messages clients that are not following skip.
+var followedMessages = map[string]bool{
+	MessagePlay:         true,
+	MessagePause:        true,
+	MessageSeek:         true,
+	MessageSeekingStart: true,
+	MessageSeekingEnd:   true,
+	MessageSyncPulse:    true,
+	MessageReadyCheck:   true,
+	MessageStart:        true,
+}
+
+var errHostFollows = errors.New("the host always follows itself")
+
+// skipsMessage reports whether client should not be sent a message of
+// msgType. The caller must hold room.mutex, for reading at least.
+func skipsMessage(client *Client, msgType string) bool {
+	return client.unfollowed && followedMessages[msgType]
+}
+
+// handleFollow starts or stops the sender following the host, telling the
+// room who is following now.
+func handleFollow(room *Room, sender *Client, msg *Message) error {
+	following := msg.Type == MessageFollow
+
+	room.mutex.Lock()
+	if room.Host == sender {
+		room.mutex.Unlock()
+		return errHostFollows
+	}
+	changed := sender.unfollowed == following
+	sender.unfollowed = !following
+	room.mutex.Unlock()
+
+	if following {
+		sendSyncState(room, sender)
+	}
+	if changed {
+		sender.logger.Debug("Client follow changed", "following", following)
+		broadcastUserList(room)
+	}
+	return nil
+}
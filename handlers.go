@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Each inbound WebSocket message type has its own handler, which applies
+// the message to the room and relays or broadcasts whatever should follow.
+// An error from a handler is sent back to the sender and nothing is
+// relayed.
+
+// messageHandler handles one inbound message from sender.
+type messageHandler func(room *Room, sender *Client, msg *Message) error
+
+// messageHandlers maps each message type clients may send to its handler.
+var messageHandlers = map[string]messageHandler{
+	MessagePlay:          handlePlayback,
+	MessagePause:         handlePlayback,
+	MessageSeek:          handlePlayback,
+	MessageSeekingStart:  handlePlayback,
+	MessageSeekingEnd:    handlePlayback,
+	MessageNext:          handleTrackChange,
+	MessagePrev:          handleTrackChange,
+	MessageSelectTrack:   handleTrackChange,
+	MessagePlaybackEnded: handlePlaybackEnded,
+	MessageChat:          handleChat,
+	MessageJoin:          handleJoin,
+	MessageKick:          kickClient,
+	MessageRequestSync:   handleRequestSync,
+	MessageJoinRoom:      handleJoinRoom,
+	MessageVolume:        handleVolume,
+	MessageMute:          handleMute,
+	MessageRename:        handleRename,
+	MessageFollow:        handleFollow,
+	MessageUnfollow:      handleFollow,
+	MessagePingTime:      handlePingTime,
+	MessageSeekRelative:  handleSeekRelative,
+	MessageTransferHost:  handleTransferHost,
+	MessageReadyCheck:    handleReadyCheck,
+	MessageReady:         handleReady,
+}
+
+// errNotHost is returned for a control message from anyone but the host.
+var errNotHost = errors.New("only the host can control playback")
+
+func handleMessage(room *Room, sender *Client, msg *Message) {
+	logger := sender.logger.With("type", msg.Type)
+	logger.Debug("WebSocket message")
+
+	handler, ok := messageHandlers[msg.Type]
+	if !ok {
+		logger.Info("Unknown message type")
+		sendError(sender, fmt.Sprintf("unknown message type %q", msg.Type))
+		return
+	}
+	if controlMessages[msg.Type] && !isHost(room, sender) {
+		logger.Info("Rejected control message from non-host")
+		sendError(sender, errNotHost.Error())
+		recordHistory(room, sender, msg, errNotHost)
+		return
+	}
+	if err := validateMessage(msg); err != nil {
+		logger.Info("Rejected invalid message", "error", err)
+		sendError(sender, err.Error())
+		recordHistory(room, sender, msg, err)
+		return
+	}
+
+	err := handler(room, sender, msg)
+	if err != nil {
+		logger.Info("Rejected message", "seq", msg.Seq, "error", err)
+		rejectControl(room, sender, err)
+	}
+	recordHistory(room, sender, msg, err)
+}
+
+// relay sends msg to everyone in the room but sender.
+func relay(room *Room, sender *Client, msg *Message) {
+	messagesRelayed.WithLabelValues(msg.Type).Inc()
+	room.Broadcast(*msg, sender)
+}
+
+// broadcast sends msg to everyone in the room, sender included.
+func broadcast(room *Room, msg Message) {
+	messagesRelayed.WithLabelValues(msg.Type).Inc()
+	room.Broadcast(msg, nil)
+}
+
+// handlePlayback applies a play, pause or seek, or the start or end of a
+// scrub, and relays it.
+func handlePlayback(room *Room, sender *Client, msg *Message) error {
+	if err := updatePlaybackState(room, msg); err != nil {
+		return err
+	}
+	persistRoom(room)
+	if msg.Type == MessageSeek && !throttleSeek(room, sender, msg) {
+		return nil
+	}
+	relay(room, sender, msg)
+	return nil
+}
+
+// handleTrackChange moves the room to another track. Everyone, the sender
+// included, is told, since they need the index the server settled on.
+func handleTrackChange(room *Room, sender *Client, msg *Message) error {
+	if err := changeTrack(room, msg); err != nil {
+		return err
+	}
+	persistRoom(room)
+	broadcast(room, *msg)
+	return nil
+}
+
+// handlePlaybackEnded moves the room on from a finished track.
+func handlePlaybackEnded(room *Room, sender *Client, msg *Message) error {
+	ended, ok := endTrack(room, msg)
+	if !ok {
+		// The server already moved on, having ended the track itself or
+		// been told to change it.
+		return nil
+	}
+	persistRoom(room)
+	broadcast(room, ended)
+	return nil
+}
+
+// handleJoin sets the sender's nickname.
+func handleJoin(room *Room, sender *Client, msg *Message) error {
+	setClientName(room, sender, msg.Name)
+	broadcastUserList(room)
+	return nil
+}
+
+// handleRequestSync sends the sender the room's state. The reply goes only
+// to the sender, so a client asking too often overflows its own send queue
+// and nobody else's.
+func handleRequestSync(room *Room, sender *Client, msg *Message) error {
+	sendSyncState(room, sender)
+	return nil
+}
+
+// handleJoinRoom ignores the join_room clients send on connect: the room is
+// already chosen by the URL, so there is nothing to do or relay.
+func handleJoinRoom(room *Room, sender *Client, msg *Message) error {
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Each room remembers its last roomHistorySize control events in a ring
+// buffer, for reproducing sync complaints after the fact. An event is
+// recorded once handleMessage has dispatched it, rejected or not, along
+// with the playback position it left the room at. The history is served to
+// the host, or to an operator with the admin token, from
+// /api/room/:id/history. It lives in memory only and starts over with the
+// room.
+
+// roomHistorySize is how many events a room remembers.
+const roomHistorySize = 200
+
+// historyMessages are the message types recorded in the history: those
+// that can move playback, and the requests clients make when they find
+// themselves out of sync.
+var historyMessages = map[string]bool{
+	MessagePlay:          true,
+	MessagePause:         true,
+	MessageSeek:          true,
+	MessageSeekRelative:  true,
+	MessageSeekingStart:  true,
+	MessageSeekingEnd:    true,
+	MessageNext:          true,
+	MessagePrev:          true,
+	MessageSelectTrack:   true,
+	MessagePlaybackEnded: true,
+	MessageRequestSync:   true,
+	MessageFollow:        true,
+	MessageUnfollow:      true,
+	MessageTransferHost:  true,
+	MessageReadyCheck:    true,
+}
+
+// HistoryEvent is one entry in a room's history.
+type HistoryEvent struct {
+	Type     string `json:"type"`
+	ClientID string `json:"clientId"`
+	// Time is the room's playback position after the event, in seconds.
+	Time  float64 `json:"time"`
+	Track int     `json:"track"`
+	// Seq is the Seq the message carried, if any.
+	Seq uint64 `json:"seq,omitempty"`
+	// Error is why the message was rejected, if it was.
+	Error string `json:"error,omitempty"`
+	// WallClock is the server time of the event in milliseconds, on the
+	// same clock as /api/time.
+	WallClock int64 `json:"wallClock"`
+}
+
+// historyRing holds up to roomHistorySize events. Once full, next is the
+// oldest, which the next event overwrites.
+type historyRing struct {
+	events []HistoryEvent
+	next   int
+}
+
+func (r *historyRing) add(event HistoryEvent) {
+	if len(r.events) < roomHistorySize {
+		r.events = append(r.events, event)
+		return
+	}
+	r.events[r.next] = event
+	r.next = (r.next + 1) % roomHistorySize
+}
+
+// snapshot copies the events out, oldest first.
+func (r *historyRing) snapshot() []HistoryEvent {
+	events := make([]HistoryEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
+}
+
+// recordHistory adds sender's msg to the room's history if it is of a
+// recorded type. err is what handling it returned.
+func recordHistory(room *Room, sender *Client, msg *Message, err error) {
+	if !historyMessages[msg.Type] {
+		return
+	}
+	event := HistoryEvent{
+		Type:      msg.Type,
+		ClientID:  sender.ID,
+		Seq:       msg.Seq,
+		WallClock: serverNow(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	room.mutex.Lock()
+	event.Time = currentPosition(room)
+	event.Track = room.CurrentTrack
+	room.history.add(event)
+	room.mutex.Unlock()
+}
+
+// handleRoomHistory serves a live room's history, oldest event first. It
+// takes the host key, as handleDeleteRoom does, or the admin token, as
+// "Authorization: Bearer <key>".
+func (s *Server) handleRoomHistory(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	room, exists := s.hub.lookupRoom(roomID)
+	if !exists {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	if !s.requireHostOrAdmin(c, room, "Only the room's host can read its history") {
+		return
+	}
+
+	// Copied under the lock and encoded outside it, so that a full buffer
+	// does not hold up the room.
+	room.mutex.RLock()
+	events := room.history.snapshot()
+	room.mutex.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"roomId": roomID,
+		"events": events,
+	})
+}
+
+// requireHostKey checks for the room's host key as "Authorization: Bearer
+// <key>". Otherwise it responds 401 for a missing key or 403 for a wrong one
+// and returns false.
+func requireHostKey(c *gin.Context, room *Room) bool {
+	key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		respondError(c, http.StatusUnauthorized, "Missing host key")
+		return false
+	}
+	if !isHostKey(room, key) {
+		respondError(c, http.StatusForbidden, "Only the room's host can do this")
+		return false
+	}
+	return true
+}
+
+// requireHostOrAdmin checks for the room's host key or the admin token as
+// "Authorization: Bearer <key>". Otherwise it responds, with forbidden as
+// the error for a key that is neither, and returns false.
+func (s *Server) requireHostOrAdmin(c *gin.Context, room *Room, forbidden string) bool {
+	key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		respondError(c, http.StatusUnauthorized, "Missing host key")
+		return false
+	}
+	isAdmin := s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AdminToken)) == 1
+	if !isAdmin && !isHostKey(room, key) {
+		respondError(c, http.StatusForbidden, forbidden)
+		return false
+	}
+	return true
+}
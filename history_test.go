@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireHostKey(t *testing.T) {
+	room := &Room{Host: &Client{hostKey: "the-key"}}
+	for header, want := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"the-key":        http.StatusUnauthorized,
+		"Bearer ":        http.StatusUnauthorized,
+		"Bearer wrong":   http.StatusForbidden,
+		"Bearer the-key": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		c.Request.Header.Set("Authorization", header)
+		ok := requireHostKey(c, room)
+		if ok != (want == http.StatusOK) || (!ok && w.Code != want) {
+			t.Errorf("Authorization %q: ok = %v, status = %d, want %d", header, ok, w.Code, want)
+		}
+	}
+}
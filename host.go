@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// The host is the one client allowed to drive playback. The first client to
+// join a room becomes host; when the host leaves, the longest-connected
+// remaining client takes over. The host can also hand the role to someone
+// else with a transfer_host naming them.
+
+// controlMessages are the message types only the host may send.
+var controlMessages = map[string]bool{
+	MessagePlay:        true,
+	MessagePause:       true,
+	MessageSeek:        true,
+	MessageNext:        true,
+	MessagePrev:        true,
+	MessageSelectTrack: true,
+
+	MessagePlaybackEnded: true,
+	MessageSeekingStart:  true,
+	MessageSeekingEnd:    true,
+	MessageSeekRelative:  true,
+
+	MessageVolume: true,
+	MessageMute:   true,
+	MessageRename: true,
+
+	MessageTransferHost: true,
+	MessageReadyCheck:   true,
+}
+
+func isHost(room *Room, client *Client) bool {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	return room.Host == client
+}
+
+// promoteNextHost picks the longest-connected client as host, or none if the
+// room is empty. The caller must hold room.mutex.
+func promoteNextHost(room *Room) {
+	var next *Client
+	for client := range room.Clients {
+		if next == nil || client.joinedAt.Before(next.joinedAt) {
+			next = client
+		}
+	}
+	setHost(room, next)
+}
+
+// setHost makes client, which may be nil, the room's host. The caller must
+// hold room.mutex.
+func setHost(room *Room, client *Client) {
+	// A scrub the old host started will never be finished.
+	room.Seeking = false
+	room.Host = client
+	// The host's playback is the room's, so it always follows.
+	if client != nil {
+		client.unfollowed = false
+	}
+}
+
+// handleTransferHost hands the host role to the client msg.ClientID names,
+// which must be connected to the room, and tells everyone.
+func handleTransferHost(room *Room, sender *Client, msg *Message) error {
+	if msg.ClientID == sender.ID {
+		return fmt.Errorf("you are already the host")
+	}
+
+	room.mutex.Lock()
+	if room.Host != sender {
+		room.mutex.Unlock()
+		return errNotHost
+	}
+	var target *Client
+	for client := range room.Clients {
+		if client.ID == msg.ClientID {
+			target = client
+			break
+		}
+	}
+	if target == nil {
+		room.mutex.Unlock()
+		return fmt.Errorf("no client with ID %q", msg.ClientID)
+	}
+	if d, ok := room.detached[target.session]; ok && d.client == target {
+		room.mutex.Unlock()
+		return fmt.Errorf("client %q is not connected", msg.ClientID)
+	}
+	setHost(room, target)
+	room.mutex.Unlock()
+
+	sender.logger.Info("Host transferred", "to", target.ID)
+	sendHostChanged(room)
+	broadcastUserList(room)
+	return nil
+}
+
+// hostMessage builds the host_changed message for one recipient. Each
+// recipient is told whether the host is them, since clients do not otherwise
+// know their own ID, and the host alone is given its host key. The caller
+// must hold room.mutex.
+func hostMessage(room *Room, client *Client) Message {
+	hostID := ""
+	if room.Host != nil {
+		hostID = room.Host.ID
+	}
+	msg := Message{
+		Type:     MessageHostChanged,
+		HostID:   hostID,
+		ClientID: client.ID,
+		IsHost:   client.ID == hostID,
+	}
+	if msg.IsHost {
+		msg.HostKey = client.hostKey
+	}
+	return msg
+}
+
+// isHostKey reports whether key is the current host's host key.
+func isHostKey(room *Room, key string) bool {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	if room.Host == nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(room.Host.hostKey)) == 1
+}
+
+// sendHostInfo tells a newly joined client who the host is.
+func sendHostInfo(room *Room, client *Client) {
+	room.mutex.RLock()
+	msg := hostMessage(room, client)
+	room.mutex.RUnlock()
+
+	client.Send(msg)
+}
+
+// sendHostChanged tells every client in the room who the host is now.
+func sendHostChanged(room *Room) {
+	room.mutex.RLock()
+	clients := make([]*Client, 0, len(room.Clients))
+	msgs := make([]Message, 0, len(room.Clients))
+	for client := range room.Clients {
+		clients = append(clients, client)
+		msgs = append(msgs, hostMessage(room, client))
+	}
+	room.mutex.RUnlock()
+
+	for i, client := range clients {
+		client.Send(msgs[i])
+	}
+}
+
+// kickClient disconnects the client msg.ClientID names and tells everyone
+// else. Only the host may kick, and not themselves. The kicked client is
+// removed from the room by its own read loop once the connection closes,
+// like any other departure.
+func kickClient(room *Room, sender *Client, msg *Message) error {
+	if !isHost(room, sender) {
+		return fmt.Errorf("only the host can kick")
+	}
+	if msg.ClientID == sender.ID {
+		return fmt.Errorf("cannot kick yourself")
+	}
+
+	room.mutex.RLock()
+	var target *Client
+	for client := range room.Clients {
+		if client.ID == msg.ClientID {
+			target = client
+			break
+		}
+	}
+	room.mutex.RUnlock()
+	if target == nil {
+		return fmt.Errorf("no client with ID %q", msg.ClientID)
+	}
+
+	target.logger.Info("Client kicked", "by", sender.ID)
+	target.Close(closeKicked)
+	// A kicked client that had already dropped has no read loop left to
+	// remove it.
+	room.mutex.Lock()
+	expireDetached(room, target)
+	room.mutex.Unlock()
+	room.Broadcast(Message{
+		Type:     MessageUserKicked,
+		RoomID:   room.ID,
+		ClientID: target.ID,
+	}, target)
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hub is the set of live rooms. It is created in main and handed to the
+// Server, so that separate instances (or tests) each get their own rooms.
+//
+// Locks are always taken hub first, then room, so that the janitor and
+// departing clients cannot race a join into a room that is being removed.
+type Hub struct {
+	config *Config
+	rooms  map[string]*Room
+	mutex  sync.RWMutex
+
+	// storage holds the rooms' tracks and store persists their state.
+	storage Storage
+	store   RoomStore
+
+	// playlistMu serialises appends so that two concurrent uploads to the
+	// same room cannot both claim the next track index, and keeps a room
+	// from being loaded while its audio is deleted. It is taken before
+	// mutex.
+	playlistMu sync.Mutex
+
+	// chatLimiter throttles chat per connection, keyed by client ID.
+	chatLimiter *rateLimiter
+
+	// newRoomID proposes IDs for generateRoomID, randomRoomID unless a test
+	// swaps in a predictable sequence. Its IDs must pass validateRoomID.
+	newRoomID func() (string, error)
+
+	// shuttingDown is set once the server starts draining, so that clients
+	// leaving because of the shutdown do not take their room's audio with
+	// them.
+	shuttingDown atomic.Bool
+
+	// ffmpegPath is the ffmpeg binary found by setupTranscoding, or empty
+	// when transcoding is off. transcodeSlots bounds how many ffmpeg
+	// processes run at once.
+	ffmpegPath     string
+	transcodeSlots chan struct{}
+}
+
+// newHub returns an empty hub keeping tracks in storage and room state in
+// store.
+func newHub(cfg *Config, storage Storage, store RoomStore) *Hub {
+	h := &Hub{
+		config:         cfg,
+		rooms:          make(map[string]*Room),
+		store:          store,
+		chatLimiter:    newRateLimiter(chatMessagesPerMinute),
+		newRoomID:      randomRoomID,
+		transcodeSlots: make(chan struct{}, maxConcurrentTranscodes),
+	}
+	h.storage = deleteHookStorage{Storage: storage, onDelete: h.trackDeleted}
+	return h
+}
+
+// randomRoomID returns a room ID from crypto/rand.
+func randomRoomID() (string, error) {
+	return randomHexID(roomIDBytes)
+}
+
+// maxRoomIDAttempts is how many random IDs generateRoomID tries before
+// giving up.
+const maxRoomIDAttempts = 5
+
+// generateRoomID returns a new room ID that no live room, stored track or
+// sidecar uses. With 64 random bits a clash means the random source is
+// broken rather than unlucky, so it gives up quickly.
+func (h *Hub) generateRoomID() (string, error) {
+	for attempt := 0; attempt < maxRoomIDAttempts; attempt++ {
+		id, err := h.newRoomID()
+		if err != nil {
+			return "", err
+		}
+		if !validateRoomID(id) {
+			return "", fmt.Errorf("generated room ID %q is malformed", id)
+		}
+		inUse, err := h.roomIDInUse(id)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			return id, nil
+		}
+		slog.Warn("Generated room ID is already in use", "roomId", id)
+	}
+	return "", fmt.Errorf("no unused room ID after %d attempts", maxRoomIDAttempts)
+}
+
+// roomIDInUse reports whether id belongs to a live room or has files in
+// storage or the uploads directory.
+func (h *Hub) roomIDInUse(id string) (bool, error) {
+	if _, exists := h.lookupRoom(id); exists {
+		return true, nil
+	}
+	sidecars, err := filepath.Glob(filepath.Join(h.config.UploadDir, id+".*"))
+	if err != nil {
+		return false, err
+	}
+	if len(sidecars) > 0 {
+		return true, nil
+	}
+	stored, err := h.storage.List(id + ".")
+	if err != nil {
+		return false, err
+	}
+	return len(stored) > 0, nil
+}
+
+// lookupRoom returns the live room with the given ID, if any.
+func (h *Hub) lookupRoom(roomID string) (*Room, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	room, exists := h.rooms[roomID]
+	return room, exists
+}
+
+// snapshot returns the live rooms, so that callers can visit them without
+// holding h.mutex.
+func (h *Hub) snapshot() []*Room {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// errTooManyRooms is returned for a new room once the hub holds
+// config.MaxRooms rooms.
+var errTooManyRooms = errors.New("the server has reached its room limit")
+
+// errRoomFull is returned by joinRoom for a room at config.MaxClientsPerRoom.
+var errRoomFull = errors.New("room is full")
+
+// loadRoom returns a new, unregistered room for roomID with its playlist and
+// settings read from storage. It must not be called with h.mutex held, so
+// that slow storage never holds up the whole hub.
+func (h *Hub) loadRoom(roomID string) *Room {
+	return &Room{
+		hub:          h,
+		ID:           roomID,
+		Clients:      make(map[*Client]bool),
+		detached:     make(map[string]*detachedClient),
+		Playlist:     h.loadPlaylist(roomID),
+		TokenHash:    h.loadTokenHash(roomID),
+		PasswordHash: h.loadPasswordHash(roomID),
+		Name:         h.loadRoomName(roomID),
+		Volume:       defaultVolume,
+		CreatedAt:    time.Now(),
+		LastActive:   time.Now(),
+	}
+}
+
+// roomCapacityLocked reports whether the hub has room for another room. A
+// full hub first drops the rooms the janitor would, so that a burst of room
+// creation does not have to wait for its next run. The caller must hold
+// h.mutex.
+func (h *Hub) roomCapacityLocked() bool {
+	if len(h.rooms) < h.config.MaxRooms {
+		return true
+	}
+	h.removeExpiredRoomsLocked(time.Now().Add(-h.config.RoomTTL))
+	return len(h.rooms) < h.config.MaxRooms
+}
+
+// hasRoomCapacity is roomCapacityLocked for handlers about to create a room
+// that will only join the hub later, such as an upload.
+func (h *Hub) hasRoomCapacity() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.roomCapacityLocked()
+}
+
+// createRoom registers roomID in the hub, without clients, unless it is
+// already live. It returns errTooManyRooms if there is no space for it.
+//
+// The room is loaded before h.mutex is taken. playlistMu is held from the
+// load until the room is registered instead, so that an upload cannot add a
+// track the load missed while the room is not yet live to take it, and
+// deleteAbandonedAudio cannot delete audio the load found.
+func (h *Hub) createRoom(roomID string) (*Room, error) {
+	h.playlistMu.Lock()
+	defer h.playlistMu.Unlock()
+	if room, exists := h.lookupRoom(roomID); exists {
+		return room, nil
+	}
+	fresh := h.loadRoom(roomID)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if room, exists := h.rooms[roomID]; exists {
+		return room, nil
+	}
+	if !h.roomCapacityLocked() {
+		return nil, errTooManyRooms
+	}
+	h.rooms[roomID] = fresh
+	return fresh, nil
+}
+
+// joinRoom looks up or creates the room and adds client to it. The lookup
+// and the add happen in one step, so the room cannot be removed from the hub
+// in between; should a room created for the client be removed before it is
+// added, it is created again. It returns errTooManyRooms or errRoomFull if
+// there is no space for the client.
+func (h *Hub) joinRoom(roomID string, client *Client) (*Room, error) {
+	for {
+		h.mutex.Lock()
+		room, exists := h.rooms[roomID]
+		if exists {
+			added := h.addClientToRoom(room, client)
+			h.mutex.Unlock()
+			if !added {
+				return nil, errRoomFull
+			}
+			return room, nil
+		}
+		h.mutex.Unlock()
+
+		if _, err := h.createRoom(roomID); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// addClientToRoom adds client to the room unless it already holds
+// config.MaxClientsPerRoom clients. The caller must hold h.mutex.
+func (h *Hub) addClientToRoom(room *Room, client *Client) bool {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if len(room.Clients) >= h.config.MaxClientsPerRoom {
+		return false
+	}
+	room.Clients[client] = true
+	room.LastActive = time.Now()
+	countJoin(room)
+	if room.Host == nil {
+		room.Host = client
+	}
+	return true
+}
+
+// removeClientFromRoom drops client from the room, handing the host role on
+// if needed. It reports whether the client was the host.
+func (h *Hub) removeClientFromRoom(room *Room, client *Client) bool {
+	h.mutex.Lock()
+	room.mutex.Lock()
+	wasHost, emptied := h.removeClientLocked(room, client)
+	room.mutex.Unlock()
+	h.mutex.Unlock()
+
+	if emptied {
+		h.deleteAbandonedAudio(room.ID)
+	}
+	return wasHost
+}
+
+// removeClientLocked is removeClientFromRoom for callers already holding
+// h.mutex and room.mutex. It also reports whether it removed the room from
+// the hub for good, in which case the caller must pass its ID to
+// deleteAbandonedAudio once it has released the locks.
+func (h *Hub) removeClientLocked(room *Room, client *Client) (wasHost, emptied bool) {
+	delete(room.Clients, client)
+	room.LastActive = time.Now()
+
+	wasHost = room.Host == client
+	if wasHost {
+		promoteNextHost(room)
+	}
+
+	// The store is updated while the locks are held so that a save can
+	// never land after the room has been deleted.
+	switch {
+	case room.Closed:
+		// deleteRoom has already removed the room and its audio, and the
+		// ID may since have been reused by a new room.
+	case len(room.Clients) > 0:
+		saveRoomState(room)
+	case h.shuttingDown.Load():
+		// Keep the room and its audio for when the server comes back.
+		delete(h.rooms, room.ID)
+		saveRoomState(room)
+	default:
+		delete(h.rooms, room.ID)
+		if err := h.store.Delete(room.ID); err != nil {
+			slog.Error("Failed to delete stored room", "roomId", room.ID, "error", err)
+		}
+		emptied = true
+	}
+	return wasHost, emptied
+}
+
+// deleteAbandonedAudio deletes the audio of a room removed from the hub for
+// being empty, unless a client has brought it back since. It must be called
+// without h.mutex held. createRoom holds playlistMu while it loads a room,
+// so holding it here means the room cannot come back halfway through.
+func (h *Hub) deleteAbandonedAudio(roomID string) {
+	h.playlistMu.Lock()
+	defer h.playlistMu.Unlock()
+	if _, exists := h.lookupRoom(roomID); exists {
+		return
+	}
+	h.deleteRoomAudio(roomID)
+}
+
+// closeAllClients closes every WebSocket connection in every room.
+func (h *Hub) closeAllClients(reason closeReason) {
+	var clients []*Client
+	for _, room := range h.snapshot() {
+		room.mutex.RLock()
+		for client := range room.Clients {
+			clients = append(clients, client)
+		}
+		room.mutex.RUnlock()
+	}
+
+	for _, client := range clients {
+		client.Close(reason)
+	}
+}
+
+// deleteRoom removes room from the hub along with its audio and stored state,
+// and returns the clients it had so the caller can disconnect them. It
+// reports false if the room was already gone.
+//
+// playlistMu is held so that an upload to the room either finishes before
+// its audio is deleted or finds the room gone, and so that nobody can
+// recreate the room while its audio is deleted after h.mutex is released.
+// Closed stops handlers still holding the room from saving it back.
+func (h *Hub) deleteRoom(room *Room) ([]*Client, bool) {
+	h.playlistMu.Lock()
+	defer h.playlistMu.Unlock()
+	h.mutex.Lock()
+
+	if h.rooms[room.ID] != room {
+		h.mutex.Unlock()
+		return nil, false
+	}
+
+	room.mutex.Lock()
+	room.Closed = true
+	clients := make([]*Client, 0, len(room.Clients))
+	for client := range room.Clients {
+		clients = append(clients, client)
+	}
+	room.mutex.Unlock()
+
+	delete(h.rooms, room.ID)
+	if err := h.store.Delete(room.ID); err != nil {
+		slog.Error("Failed to delete stored room", "roomId", room.ID, "error", err)
+	}
+	h.mutex.Unlock()
+
+	h.deleteRoomAudio(room.ID)
+	return clients, true
+}
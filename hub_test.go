@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub with the default config, keeping its uploads in
+// a temporary directory and its rooms in memory.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.UploadDir = t.TempDir()
+	return newHub(&cfg, newLocalStorage(cfg.UploadDir), newMemoryRoomStore())
+}
+
+// createRoom creates a room through the API and returns the response status.
+func createRoom(t *testing.T, srv *httptest.Server) int {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/audio-sync/api/rooms", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoomLimitRejectsNewRoomsUntilOneExpires(t *testing.T) {
+	h := newTestHub(t)
+	h.config.MaxRooms = 2
+	srv := newTestServer(t, h)
+
+	for i := 0; i < h.config.MaxRooms; i++ {
+		if status := createRoom(t, srv); status != http.StatusCreated {
+			t.Fatalf("room %d: status = %d, want %d", i, status, http.StatusCreated)
+		}
+	}
+	if status := createRoom(t, srv); status != http.StatusServiceUnavailable {
+		t.Fatalf("room over the limit: status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// An empty room idle past its TTL is dropped to make space.
+	room := h.snapshot()[0]
+	room.mutex.Lock()
+	room.LastActive = time.Now().Add(-2 * h.config.RoomTTL)
+	room.mutex.Unlock()
+	if status := createRoom(t, srv); status != http.StatusCreated {
+		t.Fatalf("room after expiry: status = %d, want %d", status, http.StatusCreated)
+	}
+	if n := len(h.snapshot()); n != h.config.MaxRooms {
+		t.Errorf("hub has %d rooms, want %d", n, h.config.MaxRooms)
+	}
+}
+
+// roomIDSequence returns a newRoomID that proposes ids in order.
+func roomIDSequence(t *testing.T, ids ...string) func() (string, error) {
+	return func() (string, error) {
+		if len(ids) == 0 {
+			t.Fatal("newRoomID called more often than expected")
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+}
+
+func TestGenerateRoomIDSkipsIDsInUse(t *testing.T) {
+	h := newTestHub(t)
+	live := "00000000000000a1"
+	tracked := "00000000000000a2"
+	sidecar := "00000000000000a3"
+	free := "00000000000000a4"
+
+	h.rooms[live] = &Room{ID: live}
+	if err := h.storage.Save(trackFilename(tracked, 0, ".mp3"), strings.NewReader("audio")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(h.config.UploadDir, sidecar+".name.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h.newRoomID = roomIDSequence(t, live, tracked, sidecar, free)
+
+	id, err := h.generateRoomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != free {
+		t.Errorf("generateRoomID() = %q, want %q", id, free)
+	}
+}
+
+func TestGenerateRoomIDGivesUp(t *testing.T) {
+	h := newTestHub(t)
+	taken := "00000000000000b1"
+	h.rooms[taken] = &Room{ID: taken}
+	ids := make([]string, maxRoomIDAttempts)
+	for i := range ids {
+		ids[i] = taken
+	}
+	h.newRoomID = roomIDSequence(t, ids...)
+
+	if id, err := h.generateRoomID(); err == nil {
+		t.Errorf("generateRoomID() = %q, want an error", id)
+	}
+}
+
+func TestGenerateRoomIDRejectsMalformed(t *testing.T) {
+	h := newTestHub(t)
+	h.newRoomID = roomIDSequence(t, "../etc")
+
+	if id, err := h.generateRoomID(); err == nil {
+		t.Errorf("generateRoomID() = %q, want an error", id)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// With IDLE_TIMEOUT set, a client that sends nothing for that long is
+// disconnected, reclaiming connections that are open but no longer used.
+// Pings and pongs keep a connection alive but do not count as activity;
+// any message the client sends does, even one the server rejects. The host
+// is exempt, since a room is driven from its connection, and a dropped
+// client waiting to resume is left to its session grace period. An idle
+// client is closed with the reason "idle_timeout" and may not resume.
+
+// idleCheckInterval is how often clients are checked for idleness, at most.
+const idleCheckInterval = time.Minute
+
+// touchClient records that the client just sent a message.
+func touchClient(client *Client) {
+	client.lastMessage.Store(time.Now().UnixNano())
+}
+
+// runIdleReaper closes idle clients until the process exits. It never
+// returns.
+func runIdleReaper(hub *Hub, timeout time.Duration) {
+	ticker := time.NewTicker(min(timeout/2, idleCheckInterval))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hub.closeIdleClients(timeout)
+	}
+}
+
+// closeIdleClients closes every client other than a host that has sent
+// nothing for timeout. Their read loops then remove them as usual.
+func (h *Hub) closeIdleClients(timeout time.Duration) {
+	cutoff := time.Now().Add(-timeout).UnixNano()
+	for _, room := range h.snapshot() {
+		var idle []*Client
+		room.mutex.RLock()
+		for client := range room.Clients {
+			if client == room.Host || client.lastMessage.Load() > cutoff {
+				continue
+			}
+			if d, ok := room.detached[client.session]; ok && d.client == client {
+				continue
+			}
+			idle = append(idle, client)
+		}
+		room.mutex.RUnlock()
+
+		for _, client := range idle {
+			client.logger.Info("Closing idle client", "timeout", timeout.String())
+			client.Close(closeIdle)
+		}
+	}
+}
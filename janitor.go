@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// janitorInterval is how often the janitor scans for expired rooms.
+const janitorInterval = 5 * time.Minute
+
+// runJanitor periodically removes rooms and uploads that have been idle for
+// longer than ttl. It never returns.
+func runJanitor(hub *Hub, uploads *chunkedUploads, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hub.cleanupExpired(ttl)
+		uploads.cleanupStale(chunkedUploadTTL)
+	}
+}
+
+// removeExpiredRoomsLocked drops the empty rooms whose LastActive is before
+// cutoff. Their audio is left for the sweep in cleanupExpired. The caller
+// must hold h.mutex.
+func (h *Hub) removeExpiredRoomsLocked(cutoff time.Time) {
+	for id, room := range h.rooms {
+		room.mutex.RLock()
+		expired := len(room.Clients) == 0 && room.LastActive.Before(cutoff)
+		room.mutex.RUnlock()
+
+		if expired {
+			delete(h.rooms, id)
+			if err := h.store.Delete(id); err != nil {
+				slog.Error("Janitor failed to delete stored room", "roomId", id, "error", err)
+			}
+			slog.Info("Janitor removed idle room", "roomId", id)
+		}
+	}
+}
+
+// cleanupExpired drops empty rooms whose LastActive is older than ttl, then
+// deletes stored tracks and upload sidecars that no longer belong to a room
+// in the hub and have not been modified within ttl.
+//
+// The files are deleted while holding playlistMu rather than h.mutex, so
+// that slow storage does not hold up the hub. createRoom needs playlistMu
+// too, so a room cannot come back between the check and the deletion.
+func (h *Hub) cleanupExpired(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+
+	h.mutex.Lock()
+	h.removeExpiredRoomsLocked(cutoff)
+	h.mutex.Unlock()
+
+	h.playlistMu.Lock()
+	defer h.playlistMu.Unlock()
+
+	stored, err := h.storage.List("")
+	if err != nil {
+		slog.Error("Janitor failed to list stored tracks", "error", err)
+	}
+	for _, file := range stored {
+		roomID, ok := uploadRoomID(file.Name)
+		if !ok {
+			continue
+		}
+		if _, active := h.lookupRoom(roomID); active || file.ModTime.After(cutoff) {
+			continue
+		}
+
+		if err := h.storage.Delete(file.Name); err != nil {
+			slog.Error("Janitor failed to remove upload", "name", file.Name, "error", err)
+			continue
+		}
+		slog.Info("Janitor removed expired upload", "name", file.Name)
+	}
+
+	// With local storage the tracks share this directory, so only the
+	// sidecars of tracks kept elsewhere are left for this pass.
+	files, err := filepath.Glob(filepath.Join(h.config.UploadDir, "*"))
+	if err != nil {
+		slog.Error("Janitor failed to list uploads", "error", err)
+		return
+	}
+
+	for _, path := range files {
+		roomID, ok := uploadRoomID(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		if _, active := h.lookupRoom(roomID); active {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			slog.Error("Janitor failed to remove upload", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Janitor removed expired upload", "path", path)
+	}
+}
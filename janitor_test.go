@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoveExpiredRoomsLocked(t *testing.T) {
+	h := newTestHub(t)
+	now := time.Now()
+	cutoff := now.Add(-h.config.RoomTTL)
+	stale := now.Add(-2 * h.config.RoomTTL)
+
+	add := func(id string, lastActive time.Time, clients int) {
+		room, err := h.createRoom(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		room.LastActive = lastActive
+		for i := 0; i < clients; i++ {
+			room.Clients[&Client{}] = true
+		}
+	}
+	add("00000000000000d1", stale, 0) // expired
+	add("00000000000000d2", stale, 1) // idle but occupied
+	add("00000000000000d3", now, 0)   // empty but recent
+
+	h.mutex.Lock()
+	h.removeExpiredRoomsLocked(cutoff)
+	h.mutex.Unlock()
+
+	for id, want := range map[string]bool{
+		"00000000000000d1": false,
+		"00000000000000d2": true,
+		"00000000000000d3": true,
+	} {
+		if _, live := h.lookupRoom(id); live != want {
+			t.Errorf("room %s live = %v, want %v", id, live, want)
+		}
+	}
+}
+
+func TestRoomCapacityLockedFreesExpiredRooms(t *testing.T) {
+	h := newTestHub(t)
+	h.config.MaxRooms = 1
+	room, err := h.createRoom("00000000000000d4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.mutex.Lock()
+	full := !h.roomCapacityLocked()
+	h.mutex.Unlock()
+	if !full {
+		t.Fatal("hub at MaxRooms with an active room has capacity")
+	}
+
+	room.LastActive = time.Now().Add(-2 * h.config.RoomTTL)
+	h.mutex.Lock()
+	free := h.roomCapacityLocked()
+	h.mutex.Unlock()
+	if !free {
+		t.Error("hub has no capacity after its only room expired")
+	}
+}
@@ -1,218 +1,1745 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
+const (
+	// pingInterval is how often the server pings each client.
+	pingInterval = 30 * time.Second
+	// pongTimeout is how long a client may stay silent before its read loop
+	// fails. It must be longer than pingInterval.
+	pongTimeout = 60 * time.Second
+	// defaultWriteTimeout bounds how long sending a single message or ping
+	// may take, unless WS_WRITE_TIMEOUT says otherwise. A client that
+	// takes longer is disconnected.
+	defaultWriteTimeout = 10 * time.Second
+	// closeWriteTimeout bounds how long sending a close frame may take.
+	closeWriteTimeout = time.Second
+	// sendBufferSize is how many outgoing messages may queue for a client
+	// before it is considered too slow and disconnected.
+	sendBufferSize = 64
+	// compressionThreshold is the smallest message, in bytes, worth
+	// compressing when WS_COMPRESSION is on. Deflate costs tens of
+	// microseconds per message whatever its size, and small messages do not
+	// shrink: a typical sync_pulse grew from 140 to 146 bytes, while a
+	// 40-track playlist went from 6.6KB to 0.6KB for about the same CPU.
+	compressionThreshold = 512
+)
+
+// shutdownTimeout bounds how long main waits for in-flight HTTP requests to
+// finish after a shutdown signal.
+const shutdownTimeout = 10 * time.Second
+
+// roomIDBytes is the number of random bytes in a room ID; the hex-encoded ID
+// is twice as long.
+const roomIDBytes = 8
+
+// allowedAudioTypes maps each accepted upload extension to the content types
+// sniffAudioType may report for a genuine file of that format.
+var allowedAudioTypes = map[string][]string{
+	".mp3":  {"audio/mpeg"},
+	".wav":  {"audio/wave"},
+	".ogg":  {"application/ogg", "audio/ogg"},
+	".flac": {"audio/flac"},
+	".m4a":  {"audio/mp4", "video/mp4"},
+}
+
+// audioContentTypes is the Content-Type served for each stored extension.
+var audioContentTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+}
+
+// acceptedExtensions lists the keys of allowedAudioTypes for error messages.
+const acceptedExtensions = ".mp3, .wav, .ogg, .flac, .m4a"
+
+// parseOrigins splits a comma-separated origin list, normalising each entry
+// so that it compares equal to a browser's Origin header.
+func parseOrigins(raw string) []string {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, strings.ToLower(origin))
+		}
+	}
+	return origins
+}
+
+// originAllowed reports whether origin is in AllowedOrigins.
+func (cfg *Config) originAllowed(origin string) bool {
+	if len(cfg.AllowedOrigins) == 0 {
 		return true
-	},
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the upgrader's origin policy. Requests without an Origin
+// header come from non-browser clients, which could forge it anyway, so they
+// are let through as gorilla/websocket does by default.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.config.originAllowed(origin) {
+		return true
+	}
+	slog.Warn("Rejected WebSocket origin", "origin", origin, "clientIp", r.RemoteAddr)
+	return false
+}
+
+type Client struct {
+	ID     string
+	conn   *websocket.Conn
+	logger *slog.Logger
+
+	// Name is the client's nickname, empty until it sends a join message.
+	// It is guarded by the mutex of the client's room.
+	Name string
+
+	// unfollowed is set while the client has stopped following the host,
+	// guarded like Name. See follow.go.
+	unfollowed bool
+
+	// hostKey is a secret given to the client only while it is host, which
+	// it presents to authenticate host-only HTTP requests. Unlike ID it is
+	// never shown to other clients.
+	hostKey string
+
+	// session is the client's secret for resuming after a dropped
+	// connection. serverClosed marks a client the server disconnected on
+	// purpose, such as for being kicked, idle, too slow or flooding, which
+	// may not resume.
+	session      string
+	serverClosed atomic.Bool
+
+	// binaryPulses is set when the connection negotiated binary sync
+	// pulses. See binary.go.
+	binaryPulses bool
+
+	// writeTimeout bounds each write to the connection, from
+	// config.WSWriteTimeout.
+	writeTimeout time.Duration
+
+	// lastMessage is when the client last sent a message, in Unix
+	// nanoseconds. See idle.go.
+	lastMessage atomic.Int64
+
+	// send queues outgoing messages for writePump. slow is closed once
+	// send overflows, telling writePump to drop the connection.
+	send     chan Message
+	slow     chan struct{}
+	slowOnce sync.Once
+	stats    writeStats
+
+	joinedAt time.Time
 }
 
 type Room struct {
 	ID      string
-	Clients map[*websocket.Conn]bool
+	Clients map[*Client]bool
 	mutex   sync.RWMutex
+
+	// hub is the hub the room belongs to, and holds its configuration.
+	hub *Hub
+
+	// Name is the room's display name, or empty. See roomname.go.
+	Name string
+
+	// Authoritative playback state, guarded by mutex. CurrentTime is the
+	// position at LastUpdate; while playing, the live position keeps
+	// advancing from there.
+	CurrentTime float64
+	IsPlaying   bool
+	LastUpdate  time.Time
+	// Seeking is set between the host's seeking_start and seeking_end,
+	// while CurrentTime is about to be replaced.
+	Seeking bool
+
+	// Volume and Muted are the host's room-wide volume settings, guarded
+	// by mutex. See volume.go.
+	Volume float64
+	Muted  bool
+
+	// Host is the client allowed to control playback.
+	Host *Client
+
+	// detached holds the clients in Clients whose connection dropped, by
+	// session token, until they resume or expire. See session.go.
+	detached map[string]*detachedClient
+
+	// Playlist is the room's tracks in play order; CurrentTrack indexes it.
+	Playlist     []Track
+	CurrentTrack int
+
+	// Seq counts changes to the playback state above. See seq.go.
+	Seq uint64
+
+	// seekThrottle limits how often seeks are relayed. See throttle.go.
+	seekThrottle seekThrottle
+
+	// subscribers are the room's event streams. See events.go.
+	subscribers map[*roomSubscriber]bool
+
+	// unavailable holds the tracks the room has been told are gone from
+	// storage. See audiocheck.go.
+	unavailable map[string]bool
+
+	// history is the room's recent control events. See history.go.
+	history historyRing
+
+	// Stats are the room's lifetime counters. See stats.go.
+	Stats RoomStats
+	// fanout counts the room's broadcasts. See roommetrics.go.
+	fanout fanoutCounters
+
+	// readyCheck is the ready check in progress, if any. See
+	// readycheck.go.
+	readyCheck *readyCheck
+
+	// TokenHash is the hash of the room's join token, or nil for an open
+	// room. See tokens.go.
+	TokenHash []byte
+	// PasswordHash is the bcrypt hash of the room's password, or nil if it
+	// has none. See password.go.
+	PasswordHash []byte
+
+	// ChatHistory holds the most recent chat messages, oldest first.
+	ChatHistory []Message
+
+	// CreatedAt is when the room was first created, kept across restarts.
+	CreatedAt time.Time
+	// LastActive is the last time a client joined, left or sent a message.
+	LastActive time.Time
+
+	// Closed is set once the room has been deleted, so that handlers still
+	// holding it do not save it back to the store.
+	Closed bool
+}
+
+// Message types exchanged over the room WebSocket.
+const (
+	MessageJoinRoom  = "join_room"
+	MessagePlay      = "play"
+	MessagePause     = "pause"
+	MessageSeek      = "seek"
+	MessageSyncState = "sync_state"
+	MessageSyncPulse = "sync_pulse"
+	MessageUserCount = "user_count"
+	MessageError     = "error"
+
+	MessageNext        = "next"
+	MessagePrev        = "prev"
+	MessageSelectTrack = "selectTrack"
+	MessagePlaylist    = "playlist"
+	MessageHostChanged = "host_changed"
+	MessageChat        = "chat"
+	MessageChatHistory = "chat_history"
+	MessageJoin        = "join"
+	MessageUserList    = "user_list"
+	MessageKick        = "kick"
+	MessageUserKicked  = "user_kicked"
+
+	// MessagePlaybackEnded is sent by the host when the current track
+	// finishes and broadcast by the server with the state it moved to.
+	MessagePlaybackEnded = "playback_ended"
+
+	// MessageSeekingStart and MessageSeekingEnd bracket the host dragging
+	// the scrubber. Only the end carries a position for clients to seek to.
+	MessageSeekingStart = "seeking_start"
+	MessageSeekingEnd   = "seeking_end"
+
+	// MessageSession gives a client the token it can resume with.
+	MessageSession = "session"
+
+	// MessageRequestSync asks for a sync_state right away, for a client
+	// that knows it has fallen out of sync.
+	MessageRequestSync = "request_sync"
+
+	// MessageRoomFull is the close reason given to a client turned away
+	// from a full room, and MessageServerFull to one turned away because
+	// the server cannot take another room.
+	MessageRoomFull   = "room_full"
+	MessageServerFull = "server_full"
+
+	// MessageVolume sets the room's volume and MessageMute mutes or
+	// unmutes it.
+	MessageVolume = "volume"
+	MessageMute   = "mute"
+
+	// MessageAnnouncement is an operator's message to every room, sent
+	// through the admin API.
+	MessageAnnouncement = "announcement"
+
+	// MessageIdleTimeout is the close reason given to a client
+	// disconnected for sending nothing for too long.
+	MessageIdleTimeout = "idle_timeout"
+
+	// MessageRename is the host changing the room's name, and
+	// MessageRoomRenamed everyone being told the new one.
+	MessageRename      = "rename"
+	MessageRoomRenamed = "room_renamed"
+
+	// MessageFollow and MessageUnfollow start and stop a client following
+	// the host's playback.
+	MessageFollow   = "follow"
+	MessageUnfollow = "unfollow"
+
+	// MessageAudioUnavailable tells clients that a track in the playlist
+	// has disappeared from storage.
+	MessageAudioUnavailable = "audio_unavailable"
+
+	// MessageWelcome is the first message on every connection.
+	MessageWelcome = "welcome"
+
+	// MessagePingTime asks for the server's clock and MessagePongTime
+	// answers it. See clock.go.
+	MessagePingTime = "ping_time"
+	MessagePongTime = "pong_time"
+
+	// MessageSeekRelative moves playback by a delta. See seekrelative.go.
+	MessageSeekRelative = "seek_relative"
+
+	// MessageTransferHost is the host handing the role to another client.
+	MessageTransferHost = "transfer_host"
+
+	// MessageReadyCheck asks clients whether they have buffered, and
+	// MessageReady is their answer; MessageStart and
+	// MessageReadyCheckFailed end the check. See readycheck.go.
+	MessageReadyCheck       = "ready_check"
+	MessageReady            = "ready"
+	MessageStart            = "start"
+	MessageReadyCheckFailed = "ready_check_failed"
+)
+
+type Message struct {
+	Type      string  `json:"type"`
+	RoomID    string  `json:"roomId"`
+	Count     int     `json:"count"`
+	IsPlaying bool    `json:"isPlaying"`
+	Track     int     `json:"track"`
+	Playlist  []Track `json:"playlist,omitempty"`
+	HostID    string  `json:"hostId,omitempty"`
+	HostKey   string  `json:"hostKey,omitempty"`
+	ClientID  string  `json:"clientId,omitempty"`
+	IsHost    bool    `json:"isHost,omitempty"`
+	Error     string  `json:"error,omitempty"`
+
+	// Time is the playback position in seconds, in play, pause, seek and
+	// state messages. It is a pointer so that a play or seek to 0 is told
+	// apart from one that leaves the position out.
+	Time *float64 `json:"time,omitempty"`
+
+	// Chat fields. Sender is the sending client's ID and Timestamp is
+	// when the server received the message, in epoch milliseconds.
+	Sender    string    `json:"sender,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Timestamp int64     `json:"timestamp,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+
+	// Name is the nickname chosen in a join message, or the room's new
+	// name in a rename message; Users lists everyone in the room in a
+	// user_list message, where Followers counts those following the host.
+	Name      string     `json:"name,omitempty"`
+	Users     []UserInfo `json:"users,omitempty"`
+	Followers int        `json:"followers,omitempty"`
+
+	// RoomName is the room's display name, in user_list, sync_state and
+	// room_renamed messages.
+	RoomName string `json:"roomName,omitempty"`
+
+	// ServerTime is when the server produced the playback state in the
+	// message, in epoch milliseconds on the clock served by /api/time, or
+	// in a pong_time when it read that clock.
+	ServerTime int64 `json:"serverTime,omitempty"`
+	// ClientTime is the sender's clock in a ping_time, echoed in the
+	// pong_time answering it.
+	ClientTime float64 `json:"clientTime,omitempty"`
+	// Delta is how many seconds a seek_relative moves playback by,
+	// backwards if negative.
+	Delta float64 `json:"delta,omitempty"`
+	// StartAt is when playback starts in a start message, in epoch
+	// milliseconds on the same clock as ServerTime.
+	StartAt int64 `json:"startAt,omitempty"`
+
+	// Seq orders playback state: the room's Seq on messages from the
+	// server, and the last one the sender saw on control messages.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Session is the client's session token, in a session message.
+	Session string `json:"session,omitempty"`
+
+	// Protocol is the protocol version the connection negotiated, in
+	// welcome and sync_state messages. See protocol.go.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Welcome fields: how many clients the room has and can take, whether
+	// it has any audio or is served the placeholder instead, and its
+	// playback state as a sync_state. See welcome.go.
+	UserCount   int      `json:"userCount,omitempty"`
+	Capacity    int      `json:"capacity,omitempty"`
+	HasAudio    bool     `json:"hasAudio,omitempty"`
+	Placeholder bool     `json:"placeholder,omitempty"`
+	SyncState   *Message `json:"syncState,omitempty"`
+
+	// Volume, from 0.0 to 1.0, and Muted are the room's volume settings,
+	// in volume, mute and sync_state messages. They are pointers so that
+	// silence and unmuting are told apart from leaving them out.
+	Volume *float64 `json:"volume,omitempty"`
+	Muted  *bool    `json:"muted,omitempty"`
 }
 
-type Hub struct {
-	rooms map[string]*Room
-	mutex sync.RWMutex
+const (
+	// clientIDBytes is the number of random bytes in a client ID.
+	clientIDBytes = 8
+	// hostKeyBytes is the number of random bytes in a client's host key.
+	hostKeyBytes = 16
+)
+
+// newClient wraps conn in a Client whose logger is logger annotated with the
+// new client's ID.
+func newClient(conn *websocket.Conn, logger *slog.Logger, writeTimeout time.Duration) *Client {
+	id := generateHexID(clientIDBytes)
+	client := &Client{
+		ID:       id,
+		conn:     conn,
+		logger:   logger.With("clientId", id),
+		send:     make(chan Message, sendBufferSize),
+		slow:     make(chan struct{}),
+		hostKey:  generateHexID(hostKeyBytes),
+		session:  generateHexID(sessionTokenBytes),
+		joinedAt: time.Now(),
+
+		binaryPulses: conn.Subprotocol() == protocolV1Binary,
+		writeTimeout: writeTimeout,
+	}
+	touchClient(client)
+	return client
 }
 
-var hub = &Hub{
-	rooms: make(map[string]*Room),
+// Send queues msg for the client without blocking. A client whose queue is
+// full is not keeping up, so rather than hold up the sender it is
+// disconnected.
+func (c *Client) Send(msg Message) {
+	select {
+	case c.send <- msg:
+	default:
+		c.recordDrop()
+		c.slowOnce.Do(func() { close(c.slow) })
+	}
 }
 
-type Message struct {
-	Type   string  `json:"type"`
-	RoomID string  `json:"roomId"`
-	Time   float64 `json:"time"`
-	Count  int     `json:"count"`
+// writePump is the only goroutine that writes messages to the connection, as
+// gorilla/websocket supports just one concurrent writer. It drains the send
+// queue and pings the client every pingInterval until done is closed. Any
+// write failure closes the connection, which ends the client's read loop.
+func (c *Client) writePump(done <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer c.logWriteStats()
+
+	for {
+		select {
+		case msg := <-c.send:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				c.logger.Error("Failed to encode message", "type", msg.Type, "error", err)
+				continue
+			}
+			frameType := websocket.TextMessage
+			if c.sendsBinary(&msg) {
+				frame := encodeBinaryPulse(&msg)
+				pulseBytesSaved.Add(float64(len(data) - len(frame)))
+				data, frameType = frame, websocket.BinaryMessage
+			}
+			// A no-op unless compression was negotiated for this connection.
+			c.conn.EnableWriteCompression(len(data) >= compressionThreshold)
+			start := time.Now()
+			c.conn.SetWriteDeadline(start.Add(c.writeTimeout))
+			if err := c.conn.WriteMessage(frameType, data); err != nil {
+				c.writeFailed("WebSocket write error", err)
+				return
+			}
+			now := time.Now()
+			c.stats.recordWrite(now.Sub(start))
+			c.checkSendQueue(now)
+		case <-ticker.C:
+			deadline := time.Now().Add(c.writeTimeout)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.writeFailed("WebSocket ping error", err)
+				return
+			}
+		case <-c.slow:
+			c.logger.Warn("Disconnecting slow client", "dropped", c.stats.dropped.Load(), "maxWriteMs", c.stats.max.Milliseconds())
+			wsSlowDisconnects.Inc()
+			c.Close(closeTooSlow)
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close sends a close frame for reason, one of those in closecodes.go, then
+// closes the connection, which also ends the client's read loop. A client
+// closed this way does not get its session held.
+// WriteControl may be called concurrently with writePump.
+func (c *Client) Close(reason closeReason) {
+	c.serverClosed.Store(true)
+	closeConn(c.conn, reason)
+}
+
+// closeConn is Client.Close for a connection that has no client yet.
+func closeConn(conn *websocket.Conn, reason closeReason) {
+	deadline := time.Now().Add(closeWriteTimeout)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(reason.code, reason.text()), deadline)
+	conn.Close()
+}
+
+// fatal logs err and exits, like log.Fatal but through slog.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	const PORT int = 8080
+	// The logger comes first so that loadConfig can warn about bad values.
+	slog.SetDefault(newLogger(os.Getenv("LOG_LEVEL")))
 
-	if err := os.MkdirAll("uploads", 0755); err != nil {
-		log.Fatal("Failed to create uploads directory:", err)
+	cfg := loadConfig()
+	config := &cfg
+	config.PlaceholderAudio = checkPlaceholderAudio(config.PlaceholderAudio)
+
+	if err := os.MkdirAll(config.UploadDir, 0755); err != nil {
+		fatal("Failed to create uploads directory", err)
 	}
 
-	router := gin.Default()
+	var storage Storage
+	switch config.Storage {
+	case "local":
+		storage = newLocalStorage(config.UploadDir)
+	case "s3":
+		s3, err := newS3Storage(config.S3)
+		if err != nil {
+			fatal("Failed to set up S3 storage", err)
+		}
+		storage = s3
+		slog.Info("Storing tracks in S3", "bucket", config.S3.Bucket, "prefix", config.S3.Prefix)
+	default:
+		fatal("Unknown storage backend", fmt.Errorf("STORAGE must be local or s3, got %q", config.Storage))
+	}
 
-	router.Static("/audio-sync/static", "./static")
+	var store RoomStore = newMemoryRoomStore()
+	if path := config.RoomStorePath; path != "" {
+		fileStore, err := newFileRoomStore(path)
+		if err != nil {
+			fatal("Failed to open room store", err)
+		}
+		store = fileStore
+	}
+	hub := newHub(config, storage, store)
+	hub.setupTranscoding(config.Transcode)
+	server := newServer(config, hub)
+	registerHubMetrics(prometheus.DefaultRegisterer, hub)
+	if err := hub.restoreRooms(); err != nil {
+		fatal("Failed to restore rooms", err)
+	}
 
-	setupRoutes(router)
+	go runJanitor(hub, server.chunked, janitorInterval, config.RoomTTL)
+	go runSyncPulse(hub, config.SyncPulseInterval)
+	go runAudioCheck(hub, audioCheckInterval)
+	if config.IdleTimeout > 0 {
+		go runIdleReaper(hub, config.IdleTimeout)
+	}
+	go server.uploadLimiter.runEviction(limiterEvictInterval, limiterIdleTTL)
+	go hub.chatLimiter.runEviction(limiterEvictInterval, limiterIdleTTL)
+	go server.authLimiter.runEviction(limiterEvictInterval, limiterIdleTTL)
+	go server.adminLimiter.runEviction(limiterEvictInterval, limiterIdleTTL)
 
-	log.Printf("Server starting on :%d", PORT)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: server.newRouter(),
+	}
+	srv.RegisterOnShutdown(server.closeEventStreams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("Server starting", "port", config.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Server failed", err)
+		}
+	}()
 
-	router.Run(fmt.Sprintf(":%d", PORT))
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	// http.Server.Shutdown does not track hijacked connections, so the
+	// WebSockets have to be closed by hand.
+	hub.shuttingDown.Store(true)
+	hub.closeAllClients(closeGoingAway)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown error", "error", err)
+	}
+	if err := hub.flushRooms(); err != nil {
+		slog.Error("Failed to save rooms", "error", err)
+	}
 }
 
-func setupRoutes(router *gin.Engine) {
-	router.GET("/audio-sync", handleIndex)
-	router.POST("/audio-sync/upload", handleUpload)
-	router.GET("/audio-sync/room/:id", handleRoom)
-	router.GET("/audio-sync/audio/:id", handleAudio)
-	router.GET("/audio-sync/ws/:id", handleWebSocket)
+// Server holds what the HTTP and WebSocket handlers share. Handlers that touch
+// rooms or the configuration are methods on it; the rest are plain functions.
+type Server struct {
+	config   *Config
+	hub      *Hub
+	upgrader websocket.Upgrader
+
+	// chunked holds the chunked uploads in progress. See chunked.go.
+	chunked *chunkedUploads
+
+	// The limiters throttle uploads, password attempts and admin requests
+	// per client IP.
+	uploadLimiter *rateLimiter
+	authLimiter   *rateLimiter
+	adminLimiter  *rateLimiter
+
+	// startedAt is when the server was created, for /api/status.
+	startedAt time.Time
+
+	// streamsDone is closed by closeEventStreams when the server shuts
+	// down. See events.go.
+	streamsDone  chan struct{}
+	closeStreams sync.Once
 }
 
-func handleIndex(c *gin.Context) {
-	c.File("static/index.html")
+// newServer returns a Server for hub, which must have been created with the
+// same cfg.
+func newServer(cfg *Config, hub *Hub) *Server {
+	s := &Server{
+		config:        cfg,
+		hub:           hub,
+		chunked:       newChunkedUploads(cfg.UploadDir),
+		uploadLimiter: newRateLimiter(cfg.UploadsPerMinute),
+		authLimiter:   newRateLimiter(authAttemptsPerMinute),
+		adminLimiter:  newRateLimiter(adminRequestsPerMinute),
+		startedAt:     time.Now(),
+		streamsDone:   make(chan struct{}),
+	}
+	s.upgrader = websocket.Upgrader{
+		ReadBufferSize:    cfg.WSReadBufferSize,
+		WriteBufferSize:   cfg.WSWriteBufferSize,
+		EnableCompression: cfg.Compression,
+		CheckOrigin:       s.checkOrigin,
+		Subprotocols:      supportedProtocols,
+	}
+	return s
 }
 
-func handleRoom(c *gin.Context) {
-	c.File("static/room.html")
+// newRouter builds the complete HTTP handler, middleware included, so that it
+// can be served by main or wrapped in an httptest.Server.
+func (s *Server) newRouter() *gin.Engine {
+	router := gin.New()
+	// gin trusts forwarding headers from everyone by default. loadConfig
+	// has already dropped malformed entries.
+	if err := router.SetTrustedProxies(s.config.TrustedProxies); err != nil {
+		slog.Error("Failed to set trusted proxies", "error", err)
+	}
+	// Probes hit these constantly; logging them drowns out real traffic.
+	router.Use(requestLogger("/healthz", "/readyz", "/metrics"), gin.Recovery())
+	router.Use(s.corsMiddleware("/audio-sync/upload", "/audio-sync/api/"))
+
+	router.Static("/audio-sync/static", s.config.StaticDir)
+
+	s.setupRoutes(router)
+	router.NoRoute(s.handleNoRoute)
+	return router
 }
 
-func handleAudio(c *gin.Context) {
+func (s *Server) setupRoutes(router *gin.Engine) {
+	limitUploads := rateLimitMiddleware(s.uploadLimiter, "Too many uploads, try again later")
+	limitAuth := rateLimitMiddleware(s.authLimiter, "Too many password attempts, try again later")
+	gateUploads := uploadGate(s.config.MaxUploads, s.config.UploadQueueWait)
+
+	router.GET("/healthz", handleHealthz)
+	router.GET("/readyz", s.handleReadyz)
+	router.GET("/metrics", handleMetrics())
+	router.GET("/audio-sync", s.handleIndex)
+	router.POST("/audio-sync/upload", limitUploads, gateUploads, s.handleUpload)
+	router.POST("/audio-sync/upload/init", limitUploads, s.handleChunkedUploadInit)
+	router.GET("/audio-sync/upload/:uploadId", s.handleChunkedUploadStatus)
+	router.PUT("/audio-sync/upload/:uploadId/chunk/:n", s.handleChunkedUploadChunk)
+	router.POST("/audio-sync/upload/:uploadId/complete", gateUploads, s.handleChunkedUploadComplete)
+	router.GET("/audio-sync/room/:id", s.handleRoom)
+	router.GET("/audio-sync/audio/:id", s.handleAudio)
+	router.GET("/audio-sync/audio/:id/:trackIndex", s.handleAudio)
+	router.GET("/audio-sync/audio/:id/download", s.handleAudioDownload)
+	router.GET("/audio-sync/audio/:id/:trackIndex/download", s.handleAudioDownload)
+	router.GET("/audio-sync/ws/:id", s.handleWebSocket)
+	router.GET("/audio-sync/api/time", handleTime)
+	router.GET("/audio-sync/api/status", s.handleStatus)
+	router.GET("/audio-sync/api/rooms", s.handleListRooms)
+	router.POST("/audio-sync/api/rooms", limitUploads, s.handleCreateRoom)
+	router.POST("/audio-sync/api/room/:id/auth", limitAuth, s.handleRoomAuth)
+	router.GET("/audio-sync/api/room/:id", s.handleRoomInfo)
+	router.DELETE("/audio-sync/api/room/:id", s.handleDeleteRoom)
+	router.GET("/audio-sync/api/room/:id/peaks", s.handlePeaks)
+	router.GET("/audio-sync/api/room/:id/waveform.png", s.handleWaveform)
+	router.POST("/audio-sync/api/room/:id/clip", limitUploads, s.handleClip)
+	router.GET("/audio-sync/api/room/:id/state", s.handleRoomState)
+	router.GET("/audio-sync/api/room/:id/events", s.handleRoomEvents)
+	router.GET("/audio-sync/api/room/:id/history", s.handleRoomHistory)
+	router.GET("/audio-sync/api/room/:id/metrics", s.handleRoomMetrics)
+	router.POST("/audio-sync/api/room/:id/rotate-token", s.handleRotateToken)
+
+	if s.config.AdminToken != "" {
+		limitAdmin := rateLimitMiddleware(s.adminLimiter, "Too many admin requests, try again later")
+		router.POST("/admin/announce", limitAdmin, s.requireAdmin, s.handleAnnounce)
+	}
+}
+
+// handleStatus reports how long the server has been up and how busy it is.
+func (s *Server) handleStatus(c *gin.Context) {
+	rooms := s.hub.snapshot()
+	clients := 0
+	for _, room := range rooms {
+		room.mutex.RLock()
+		clients += len(room.Clients)
+		room.mutex.RUnlock()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"startedAt":     s.startedAt.UTC(),
+		"uptimeSeconds": time.Since(s.startedAt).Seconds(),
+		"rooms":         len(rooms),
+		"clients":       clients,
+	})
+}
+
+func handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz reports ready only while uploads can actually be stored.
+func (s *Server) handleReadyz(c *gin.Context) {
+	if err := s.hub.checkUploadDirWritable(); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "unavailable",
+			"error":  "Uploads directory is not writable",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s *Server) handleIndex(c *gin.Context) {
+	c.File(filepath.Join(s.config.StaticDir, "index.html"))
+}
+
+func (s *Server) handleRoom(c *gin.Context) {
+	c.File(filepath.Join(s.config.StaticDir, "room.html"))
+}
+
+// handleAudio serves one track of a room's playlist. Without a track index
+// it serves the first track, which is all a single-file room has.
+func (s *Server) handleAudio(c *gin.Context) {
 	roomId := c.Param("id")
+	if !validateRoomID(roomId) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomId) {
+		return
+	}
+
+	index := 0
+	if raw := c.Param("trackIndex"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			respondError(c, http.StatusBadRequest, "Invalid track index")
+			return
+		}
+		index = n
+	}
+
+	name, ok := s.hub.findTrackAudio(roomId, index)
+	if !ok {
+		if s.hub.usesPlaceholder(roomId) {
+			s.servePlaceholderAudio(c)
+			return
+		}
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+
+	if isRemoteTrack(name) {
+		s.serveRemoteAudio(c, name)
+		return
+	}
+	variants := s.hub.audioVariants(name)
+	c.Header("Vary", "Accept")
+	chosen, ok := chooseAudioVariant(variants, c.Query("format"), c.GetHeader("Accept"))
+	if !ok {
+		respondError(c, http.StatusNotAcceptable, "No acceptable audio format, available: "+variantFormats(variants))
+		return
+	}
+	s.serveAudioFile(c, chosen)
+}
+
+// serveAudioFile streams the track stored as name, honouring Range requests
+// so that browsers can fetch just the chunk they need when the user seeks.
+func (s *Server) serveAudioFile(c *gin.Context, name string) {
+	file, info, err := s.hub.storage.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to open audio", "track", name, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to read audio file")
+		return
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(name))
+	contentType, ok := audioContentTypes[ext]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Type", contentType)
+	if s.shouldGzipAudio(c, ext) {
+		w := newGzipResponseWriter(c.Writer)
+		defer w.Close()
+		http.ServeContent(w, c.Request, info.Name, info.ModTime, file)
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, info.Name, info.ModTime, file)
+}
+
+// findRoomAudio returns the file name of the first track uploaded for roomID.
+func (h *Hub) findRoomAudio(roomID string) (string, bool) {
+	return h.findTrackAudio(roomID, 0)
+}
+
+const (
+	defaultRoomListLimit = 100
+	maxRoomListLimit     = 1000
+)
+
+type RoomSummary struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	UserCount  int       `json:"userCount"`
+	HasAudio   bool      `json:"hasAudio"`
+	LastActive time.Time `json:"lastActive"`
+}
+
+// handleListRooms returns summaries of the active rooms ordered by ID. The
+// limit and offset query parameters page through the list.
+func (s *Server) handleListRooms(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRoomListLimit)))
+	if err != nil || limit <= 0 || limit > maxRoomListLimit {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxRoomListLimit))
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(c, http.StatusBadRequest, "offset must be a non-negative integer")
+		return
+	}
+
+	s.hub.mutex.RLock()
+	summaries := make([]RoomSummary, 0, len(s.hub.rooms))
+	for _, room := range s.hub.rooms {
+		room.mutex.RLock()
+		summaries = append(summaries, RoomSummary{
+			ID:         room.ID,
+			Name:       room.Name,
+			UserCount:  len(room.Clients),
+			LastActive: room.LastActive,
+		})
+		room.mutex.RUnlock()
+	}
+	s.hub.mutex.RUnlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ID < summaries[j].ID
+	})
+
+	if offset > len(summaries) {
+		offset = len(summaries)
+	}
+	summaries = summaries[offset:]
+	if len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+
+	// Check for audio only on the page being returned, outside the locks.
+	for i := range summaries {
+		_, summaries[i].HasAudio = s.hub.findRoomAudio(summaries[i].ID)
+	}
+
+	c.JSON(http.StatusOK, summaries)
+}
+
+// handleCreateRoom registers a new room, so that it can be shared before
+// anything is uploaded to it. The optional JSON body {"url": "..."} makes
+// the room play audio hosted elsewhere; otherwise it starts empty and tracks
+// are added by uploading with the room's ID. {"private": true} gives the
+// room a join token.
+func (s *Server) handleCreateRoom(c *gin.Context) {
+	var req struct {
+		URL      string `json:"url"`
+		Private  bool   `json:"private"`
+		Password string `json:"password"`
+		Name     string `json:"name"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	name, err := cleanRoomName(req.Name)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Password != "" {
+		if err := validatePassword(req.Password); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if !s.requireUploadDir(c) || !s.requireRoomCapacity(c) {
+		return
+	}
+
+	roomID, err := s.hub.generateRoomID()
+	if err != nil {
+		slog.Error("Failed to generate room ID", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to create room")
+		return
+	}
+
+	if req.URL != "" {
+		if err := checkRemoteAudio(c.Request.Context(), req.URL); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.hub.playlistMu.Lock()
+		_, err := s.hub.saveRemoteTrack(roomID, 0, req.URL)
+		s.hub.playlistMu.Unlock()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "Failed to save audio URL")
+			return
+		}
+	}
+
+	resp := gin.H{"roomId": roomID}
+	if req.Private {
+		token, err := s.hub.createJoinToken(roomID)
+		if err != nil {
+			s.hub.deleteRoomAudio(roomID)
+			respondError(c, http.StatusInternalServerError, "Failed to create join token")
+			return
+		}
+		resp["joinToken"] = token
+	}
+	if req.Password != "" {
+		if err := s.hub.setRoomPassword(roomID, req.Password); err != nil {
+			slog.Error("Failed to save room password", "roomId", roomID, "error", err)
+			s.hub.deleteRoomAudio(roomID)
+			respondError(c, http.StatusInternalServerError, "Failed to set room password")
+			return
+		}
+	}
+	if err := s.hub.saveRoomName(roomID, name); err != nil {
+		slog.Error("Failed to save room name", "roomId", roomID, "error", err)
+		s.hub.deleteRoomAudio(roomID)
+		respondError(c, http.StatusInternalServerError, "Failed to name room")
+		return
+	}
+
+	room, err := s.hub.createRoom(roomID)
+	if err != nil {
+		s.hub.deleteRoomAudio(roomID)
+		s.respondTooManyRooms(c)
+		return
+	}
+	persistRoom(room)
+
+	slog.Info("Room created", "roomId", roomID, "clientIp", c.ClientIP(), "private", req.Private, "password", req.Password != "")
+	c.JSON(http.StatusCreated, resp)
+}
+
+// requireRoomCapacity responds 503 and returns false if the server cannot
+// take another room.
+func (s *Server) requireRoomCapacity(c *gin.Context) bool {
+	if s.hub.hasRoomCapacity() {
+		return true
+	}
+	s.respondTooManyRooms(c)
+	return false
+}
+
+func (s *Server) respondTooManyRooms(c *gin.Context) {
+	slog.Warn("Rejected new room, server has too many rooms", "limit", s.config.MaxRooms, "clientIp", c.ClientIP())
+	// Idle rooms are freed by the janitor, so that is when to come back.
+	c.Header("Retry-After", strconv.Itoa(int(janitorInterval.Seconds())))
+	respondError(c, http.StatusServiceUnavailable, "The server has too many rooms, try again later")
+}
+
+type RoomInfo struct {
+	Exists        bool    `json:"exists"`
+	Name          string  `json:"name,omitempty"`
+	UserCount     int     `json:"userCount"`
+	AudioFilename string  `json:"audioFilename"`
+	IsPlaying     bool    `json:"isPlaying"`
+	CurrentTime   float64 `json:"currentTime"`
+	// AgeSeconds is how long ago a live room was created.
+	AgeSeconds float64 `json:"ageSeconds,omitempty"`
+
+	// PasswordProtected tells clients to get an auth token from
+	// /api/room/:id/auth before joining.
+	PasswordProtected bool `json:"passwordProtected"`
+	// Placeholder is set when the room has no tracks and its audio URL
+	// serves PLACEHOLDER_AUDIO. See placeholder.go.
+	Placeholder bool `json:"placeholder,omitempty"`
+	// Stats are a live room's lifetime counters. See stats.go.
+	Stats *RoomStats `json:"stats,omitempty"`
+
+	// Metadata describes the track currently playing, or the first
+	// track if nobody has joined yet.
+	Metadata *AudioMetadata `json:"metadata,omitempty"`
+	Playlist []Track        `json:"playlist,omitempty"`
+}
+
+// handleDeleteRoom tears down a live room: its clients are disconnected and
+// its audio deleted. Only the current host may do this, authenticating with
+// the hostKey from its host_changed message as "Authorization: Bearer <key>".
+func (s *Server) handleDeleteRoom(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	room, exists := s.hub.lookupRoom(roomID)
+	if !exists {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	if !requireHostKey(c, room) {
+		return
+	}
+
+	clients, deleted := s.hub.deleteRoom(room)
+	if !deleted {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+	for _, client := range clients {
+		client.Close(closeRoomClosed)
+	}
+
+	slog.Info("Room deleted by host", "roomId", roomID, "clientIp", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "Room deleted"})
+}
+
+// handleRoomInfo describes a single room so the frontend can tell whether it
+// is worth connecting to. Exists reports whether the room is live in the hub;
+// a room whose audio has been uploaded but that nobody has joined yet is
+// still returned.
+func (s *Server) handleRoomInfo(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
 
-	files, err := filepath.Glob(filepath.Join("uploads", roomId+".*"))
-	if err != nil || len(files) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Audio file not found"})
+	var info RoomInfo
+	current := 0
+
+	room, exists := s.hub.lookupRoom(roomID)
+	if exists {
+		room.mutex.RLock()
+		info.Exists = true
+		info.UserCount = len(room.Clients)
+		info.IsPlaying = room.IsPlaying
+		info.CurrentTime = currentPosition(room)
+		info.AgeSeconds = time.Since(room.CreatedAt).Seconds()
+		stats := room.Stats.snapshot()
+		info.Stats = &stats
+		current = room.CurrentTrack
+		room.mutex.RUnlock()
+	}
+
+	info.Name = s.hub.roomName(roomID)
+	info.PasswordProtected = s.hub.roomPasswordHash(roomID) != nil
+	info.Playlist = s.hub.loadPlaylist(roomID)
+	// CurrentTrack is a position in the playlist, not a track index, which
+	// differ once a track has been removed.
+	if current >= 0 && current < len(info.Playlist) {
+		info.AudioFilename = info.Playlist[current].Filename
+		info.Metadata = &info.Playlist[current].AudioMetadata
+	}
+
+	if !exists && len(info.Playlist) == 0 {
+		respondError(c, http.StatusNotFound, "Room not found")
 		return
 	}
+	info.Placeholder = exists && len(info.Playlist) == 0 && s.config.PlaceholderAudio != ""
 
-	c.File(files[0])
+	c.JSON(http.StatusOK, info)
 }
 
-func handleWebSocket(c *gin.Context) {
+func (s *Server) handleWebSocket(c *gin.Context) {
 	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	logger := slog.With("roomId", roomID, "clientIp", c.ClientIP())
+
+	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logger.Warn("WebSocket upgrade error", "error", err)
 		return
 	}
 	defer conn.Close()
 
-	room := getOrCreateRoom(roomID)
-	addClientToRoom(room, conn)
+	protocol := conn.Subprotocol()
+	if !supportsProtocol(protocol) {
+		logger.Info("Rejected client, unsupported protocol", "offered", websocket.Subprotocols(c.Request))
+		closeConn(conn, closeUnsupportedProtocol)
+		return
+	}
 
-	broadcastUserCount(room)
+	// Past the limit ReadMessage fails and gorilla/websocket closes the
+	// connection with 1009 (message too big).
+	conn.SetReadLimit(s.config.MaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
 
+	done := make(chan struct{})
+	defer close(done)
+
+	room, client, resumed := s.hub.resumeSession(roomID, c.Query("session"), conn, logger)
+	if resumed {
+		client.logger.Info("Client resumed session")
+		go client.writePump(done)
+	} else {
+		client = newClient(conn, logger, s.config.WSWriteTimeout)
+		client.logger.Info("Client connected")
+		go client.writePump(done)
+
+		var err error
+		room, err = s.hub.joinRoom(roomID, client)
+		if errors.Is(err, errTooManyRooms) {
+			client.logger.Warn("Rejected client, server has too many rooms")
+			client.Close(closeServerFull)
+			return
+		}
+		if err != nil {
+			client.logger.Info("Rejected client, room is full")
+			client.Close(closeRoomFull)
+			return
+		}
+		persistRoom(room)
+	}
+	sendWelcome(room, client)
+	sendSyncState(room, client)
+
+	sendHostInfo(room, client)
+	sendChatHistory(room, client)
+	sendSession(client)
+	if !resumed {
+		broadcastUserCount(room)
+		broadcastUserList(room)
+	}
+
+	limiter := newMessageLimiter(s.config.WSMessageRate, time.Now())
 	for {
-		var msg Message
-		err := conn.ReadJSON(&msg)
+		// Reading and decoding are kept apart: a read error means the
+		// connection is gone or over its limit, while a message that is not
+		// valid JSON is the client's mistake and costs it only an error.
+		var data []byte
+		_, data, err = conn.ReadMessage()
 		if err != nil {
-			log.Printf("WebSocket read error: %v", err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				client.logger.Warn("Disconnecting client for an oversized message", "limit", s.config.MaxMessageBytes)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				client.logger.Warn("WebSocket read error", "error", err)
+			}
 			break
 		}
+		touchClient(client)
 
-		handleMessage(room, conn, &msg)
+		if !limiter.allow(time.Now()) {
+			wsMessagesRateLimited.Inc()
+			if limiter.flooding() {
+				client.logger.Warn("Disconnecting client for flooding messages", "perSecond", s.config.WSMessageRate)
+				client.Close(closeRateLimited)
+				err = errMessageFlood
+				break
+			}
+			if limiter.dropped == 1 {
+				client.logger.Info("Throttling client messages", "perSecond", s.config.WSMessageRate)
+				sendError(client, "too many messages, some were dropped")
+			}
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			client.logger.Info("Rejected malformed message", "error", err)
+			sendError(client, "malformed message: "+err.Error())
+			continue
+		}
+
+		// The socket's room is fixed by the URL, so a client naming another
+		// room is buggy or up to something. An omitted roomId is fine; in
+		// either case the server stamps the real one before relaying.
+		if msg.RoomID != "" && msg.RoomID != room.ID {
+			client.logger.Warn("Rejected message for another room", "type", msg.Type, "messageRoomId", msg.RoomID)
+			sendError(client, "message is for a different room")
+			continue
+		}
+		msg.RoomID = room.ID
+
+		touchRoom(room, msg.Type)
+		handleMessage(room, client, &msg)
 	}
 
-	removeClientFromRoom(room, conn)
+	// Every way a client goes away ends up here: the peer closing, a missed
+	// pong, or writePump closing the connection after a failed write or a
+	// full send queue. Removing the client only on this path means it is
+	// removed exactly once, and never while a broadcast holds the room lock.
+	// A connection that dropped rather than closed may be resumed instead.
+	if canResume(client, err) && s.hub.detachClient(room, client) {
+		client.logger.Info("Client disconnected, holding session")
+		return
+	}
+	wasHost := s.hub.removeClientFromRoom(room, client)
+	client.logger.Info("Client disconnected")
 	broadcastUserCount(room)
+	broadcastUserList(room)
+	if wasHost {
+		sendHostChanged(room)
+	}
 }
 
-func getOrCreateRoom(roomID string) *Room {
-	hub.mutex.Lock()
-	defer hub.mutex.Unlock()
-
-	room, exists := hub.rooms[roomID]
-	if !exists {
-		room = &Room{
-			ID:      roomID,
-			Clients: make(map[*websocket.Conn]bool),
+// deleteRoomAudio removes the uploaded audio for roomID, if any, and then
+// the sidecars in the uploads directory. With local storage both live in
+// the same directory, so the second pass only finds what the first missed.
+func (h *Hub) deleteRoomAudio(roomID string) {
+	stored, err := h.storage.List(roomID + ".")
+	if err != nil {
+		slog.Error("Failed to look up audio", "roomId", roomID, "error", err)
+	}
+	for _, file := range stored {
+		if err := h.storage.Delete(file.Name); err != nil {
+			slog.Error("Failed to delete audio", "roomId", roomID, "track", file.Name, "error", err)
+			continue
 		}
-		hub.rooms[roomID] = room
+		slog.Info("Deleted audio for empty room", "roomId", roomID, "track", file.Name)
 	}
 
-	return room
+	files, err := filepath.Glob(filepath.Join(h.config.UploadDir, roomID+".*"))
+	if err != nil {
+		slog.Error("Failed to look up audio", "roomId", roomID, "error", err)
+		return
+	}
+	for _, path := range files {
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to delete audio", "roomId", roomID, "path", path, "error", err)
+		}
+	}
 }
 
-func addClientToRoom(room *Room, conn *websocket.Conn) {
+// touchRoom records a message of msgType from one of the room's clients.
+func touchRoom(room *Room, msgType string) {
 	room.mutex.Lock()
 	defer room.mutex.Unlock()
-	room.Clients[conn] = true
+	room.LastActive = time.Now()
+	countMessage(room, msgType)
 }
 
-func removeClientFromRoom(room *Room, conn *websocket.Conn) {
-	room.mutex.Lock()
-	defer room.mutex.Unlock()
-	delete(room.Clients, conn)
+func broadcastUserCount(room *Room) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	room.broadcastLocked(Message{
+		Type:  MessageUserCount,
+		Count: len(room.Clients),
+	}, nil)
+}
 
-	if len(room.Clients) == 0 {
-		hub.mutex.Lock()
-		defer hub.mutex.Unlock()
-		delete(hub.rooms, room.ID)
+// currentPosition returns the room's live playback position. The caller must
+// hold room.mutex.
+func currentPosition(room *Room) float64 {
+	if !room.IsPlaying {
+		return room.CurrentTime
 	}
+	// LastUpdate is ahead of now while a start is scheduled.
+	return room.CurrentTime + max(time.Since(room.LastUpdate), 0).Seconds()
 }
 
-func broadcastUserCount(room *Room) {
+func sendSyncState(room *Room, client *Client) {
 	room.mutex.RLock()
-	count := len(room.Clients)
-	clients := make([]*websocket.Conn, 0, count)
-	for client := range room.Clients {
-		clients = append(clients, client)
-	}
+	msg := syncStateMessage(room, client)
 	room.mutex.RUnlock()
 
-	msg := Message{
-		Type:  "user_count",
-		Count: count,
+	client.Send(msg)
+}
+
+// syncStateMessage is the sync_state for client. The caller must hold
+// room.mutex.
+func syncStateMessage(room *Room, client *Client) Message {
+	position, volume, muted := currentPosition(room), room.Volume, room.Muted
+	return Message{
+		Type:       MessageSyncState,
+		RoomID:     room.ID,
+		RoomName:   room.Name,
+		Time:       &position,
+		IsPlaying:  room.IsPlaying,
+		Track:      room.CurrentTrack,
+		Playlist:   append([]Track(nil), room.Playlist...),
+		Seq:        room.Seq,
+		ServerTime: serverNow(),
+		Volume:     &volume,
+		Muted:      &muted,
+		Protocol:   client.conn.Subprotocol(),
 	}
+}
 
-	for _, client := range clients {
-		client.WriteJSON(msg)
+// updatePlaybackState applies a play, pause or seek to the room's
+// authoritative state. msg.Time is the position the sender was at (play,
+// pause) or wants to jump to (seek, seeking_end).
+func updatePlaybackState(room *Room, msg *Message) error {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if err := checkSeq(room, msg); err != nil {
+		return err
+	}
+
+	// seeking_start only marks the scrub; the position stays put until
+	// seeking_end, or any other change, brings the final one.
+	room.Seeking = msg.Type == MessageSeekingStart
+	switch msg.Type {
+	case MessagePlay:
+		room.IsPlaying = true
+	case MessagePause:
+		room.IsPlaying = false
+	}
+
+	if !room.Seeking {
+		room.CurrentTime = *msg.Time
+		room.LastUpdate = time.Now()
+	}
+	if msg.Type != MessageSeek {
+		dropHeldSeek(room)
 	}
+	msg.Seq = bumpSeq(room)
+	msg.ServerTime = serverNow()
+	return nil
 }
 
-func handleMessage(room *Room, sender *websocket.Conn, msg *Message) {
-	room.mutex.RLock()
-	clients := make([]*websocket.Conn, 0, len(room.Clients))
-	for client := range room.Clients {
-		if client != sender {
-			clients = append(clients, client)
+func sendError(client *Client, text string) {
+	client.Send(Message{
+		Type:  MessageError,
+		Error: text,
+	})
+}
+
+// randomHexID returns n random bytes, hex encoded.
+func randomHexID(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("reading random bytes: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// generateHexID is randomHexID for IDs whose callers cannot fail. The
+// system's random source failing leaves nothing safe to hand out, so it
+// panics.
+func generateHexID(n int) string {
+	id, err := randomHexID(n)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// validateRoomID reports whether id has the exact shape produced by
+// Hub.generateRoomID. Room IDs end up in filesystem paths and glob patterns, so
+// anything else must be rejected before it gets near the uploads directory.
+func validateRoomID(id string) bool {
+	return isHexID(id, roomIDBytes)
+}
+
+// isHexID reports whether id is exactly n bytes of lowercase hex.
+func isHexID(id string, n int) bool {
+	if len(id) != n*2 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		if (ch < '0' || ch > '9') && (ch < 'a' || ch > 'f') {
+			return false
 		}
 	}
-	room.mutex.RUnlock()
+	return true
+}
 
-	for _, client := range clients {
-		client.WriteJSON(msg)
+// sniffAudioType identifies the content type of the first bytes of a file.
+// http.DetectContentType only recognises MP3s that start with an ID3 tag and
+// knows nothing about FLAC, so those are checked by hand.
+func sniffAudioType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if contentType != "application/octet-stream" {
+		return contentType
 	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "audio/flac"
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync.
+		return "audio/mpeg"
+	}
+	return contentType
 }
 
-func generateRoomID() string {
-	bytes := make([]byte, 8)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+// isAllowedAudio reports whether the sniffed content type matches what a file
+// with extension ext should contain.
+func isAllowedAudio(ext, contentType string) bool {
+	for _, allowed := range allowedAudioTypes[ext] {
+		if contentType == allowed {
+			return true
+		}
+	}
+	return false
 }
 
-func handleUpload(c *gin.Context) {
-	file, header, err := c.Request.FormFile("audio")
+// saveUploadedTrack copies an uploaded file into storage as name, returning
+// its SHA-256.
+func (h *Hub) saveUploadedTrack(header *multipart.FileHeader, name string) (string, error) {
+	file, err := header.Open()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
-		return
+		return "", err
 	}
 	defer file.Close()
+	return h.saveHashed(name, file)
+}
 
-	roomID := generateRoomID()
+// handleUpload stores one or more audio files. Without a roomId form field
+// it creates a new room whose playlist is the uploaded files in order; with
+// one, the files are appended to that live room's playlist, which takes the
+// host key as "Authorization: Bearer <key>".
+func (s *Server) handleUpload(c *gin.Context) {
+	logger := slog.With("clientIp", c.ClientIP())
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.config.MaxUploadBytes)
+	if !s.requireDiskSpace(c, c.Request.ContentLength) {
+		return
+	}
 
-	ext := filepath.Ext(header.Filename)
-	filename := roomID + ext
-	filePath := filepath.Join("uploads", filename)
+	form, err := c.MultipartForm()
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File too large, maximum size is %d bytes", s.config.MaxUploadBytes))
+			return
+		}
+		respondError(c, http.StatusBadRequest, "No file provided")
+		return
+	}
 
-	if err := c.SaveUploadedFile(header, filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	headers := form.File["audio"]
+	if len(headers) == 0 {
+		respondError(c, http.StatusBadRequest, "No file provided")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"roomId":  roomID,
+	// Validate and probe every file before saving any, so a bad file in a
+	// batch leaves nothing behind.
+	exts := make([]string, len(headers))
+	probed := make([]AudioMetadata, len(headers))
+	for i, header := range headers {
+		if len(header.Filename) > maxUploadFilenameBytes {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Filenames must be at most %d bytes", maxUploadFilenameBytes))
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Failed to read file")
+			return
+		}
+		ext, md, ok := s.requireValidUpload(c, file, header.Size, header.Filename)
+		file.Close()
+		if !ok {
+			return
+		}
+		exts[i], probed[i] = ext, md
+	}
+
+	target, ok := s.requireUploadTarget(c)
+	if !ok {
+		return
+	}
+	if !s.requireUploadDir(c) {
+		return
+	}
+
+	s.hub.playlistMu.Lock()
+	next, ok := s.uploadTrackIndex(c, target)
+	if !ok {
+		s.hub.playlistMu.Unlock()
+		return
+	}
+
+	tracks := make([]Track, 0, len(headers))
+	saved := make([]string, 0, len(headers))
+	var totalBytes int64
+	for i, header := range headers {
+		filename := trackFilename(target.roomID, next+i, exts[i])
+
+		// Storage saves through a temporary file, so a failed save leaves
+		// no partial track under filename.
+		sum, err := s.hub.saveUploadedTrack(header, filename)
+		if err != nil {
+			logger.Error("Failed to save upload", "roomId", target.roomID, "track", filename, "error", err)
+			s.hub.removeOrphanedAudio(saved)
+			s.hub.playlistMu.Unlock()
+			respondError(c, http.StatusInternalServerError, "Failed to save file")
+			return
+		}
+
+		md := labelAudio(probed[i], filename, header.Filename)
+		md.SHA256 = sum
+		if err := s.hub.saveAudioMetadata(filename, md); err != nil {
+			logger.Error("Failed to save metadata", "track", filename, "error", err)
+		}
+
+		saved = append(saved, filename)
+		tracks = append(tracks, Track{Index: next + i, Filename: filename, AudioMetadata: md})
+		totalBytes += header.Size
+	}
+	s.hub.playlistMu.Unlock()
+
+	s.finishUpload(c, target, tracks, totalBytes)
+}
+
+// uploadTarget is the room an upload goes to, from the form fields that every
+// kind of upload takes.
+type uploadTarget struct {
+	roomID    string
+	appending bool
+	private   bool
+	password  string
+	name      string
+}
+
+// requireUploadTarget reads and checks an upload's roomId, password, name and
+// private form fields. With a roomId the upload is appended to that live
+// room, which takes its host key; without one a new room ID is generated if
+// the server has room for another room.
+func (s *Server) requireUploadTarget(c *gin.Context) (uploadTarget, bool) {
+	target := uploadTarget{
+		roomID:   c.PostForm("roomId"),
+		private:  c.PostForm("private") == "true",
+		password: c.PostForm("password"),
+	}
+	target.appending = target.roomID != ""
+	if target.password != "" {
+		if target.appending {
+			respondError(c, http.StatusBadRequest, "A password can only be set when creating a room")
+			return target, false
+		}
+		if err := validatePassword(target.password); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return target, false
+		}
+	}
+	name, err := cleanRoomName(c.PostForm("name"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return target, false
+	}
+	if name != "" && target.appending {
+		respondError(c, http.StatusBadRequest, "A name can only be set when creating a room")
+		return target, false
+	}
+	target.name = name
+	if target.appending {
+		if !validateRoomID(target.roomID) {
+			respondError(c, http.StatusBadRequest, "Invalid room ID")
+			return target, false
+		}
+		room, exists := s.hub.lookupRoom(target.roomID)
+		if !exists {
+			respondError(c, http.StatusNotFound, "Room not found")
+			return target, false
+		}
+		return target, requireHostKey(c, room)
+	}
+	if !s.requireRoomCapacity(c) {
+		return target, false
+	}
+	target.roomID, err = s.hub.generateRoomID()
+	if err != nil {
+		slog.Error("Failed to generate room ID", "clientIp", c.ClientIP(), "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to create room")
+		return target, false
+	}
+	return target, true
+}
+
+// uploadTrackIndex returns the index of an upload's first track, or responds
+// 404 if the room it is appended to has gone since requireUploadTarget. The
+// caller must hold s.hub.playlistMu until the tracks are saved.
+func (s *Server) uploadTrackIndex(c *gin.Context, target uploadTarget) (int, bool) {
+	next := s.hub.nextTrackIndex(target.roomID)
+	if _, live := s.hub.lookupRoom(target.roomID); target.appending && next == 0 && !live {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return 0, false
+	}
+	return next, true
+}
+
+// finishUpload adds saved tracks to their room, gives a new room its join
+// token, password and name, and responds with where to play them.
+func (s *Server) finishUpload(c *gin.Context, target uploadTarget, tracks []Track, totalBytes int64) {
+	logger := slog.With("clientIp", c.ClientIP())
+	for _, track := range tracks {
+		s.hub.transcodeInBackground(track.Filename)
+	}
+
+	resp := gin.H{
+		"roomId":  target.roomID,
+		"tracks":  tracks,
 		"message": "File uploaded successfully",
-	})
+	}
+	token := c.Query("token")
+	if target.appending {
+		s.hub.appendTracks(target.roomID, tracks)
+	} else if target.private {
+		var err error
+		if token, err = s.hub.createJoinToken(target.roomID); err != nil {
+			s.hub.deleteRoomAudio(target.roomID)
+			respondError(c, http.StatusInternalServerError, "Failed to create join token")
+			return
+		}
+		resp["joinToken"] = token
+	}
+	if target.password != "" {
+		if err := s.hub.setRoomPassword(target.roomID, target.password); err != nil {
+			logger.Error("Failed to save room password", "roomId", target.roomID, "error", err)
+			s.hub.deleteRoomAudio(target.roomID)
+			respondError(c, http.StatusInternalServerError, "Failed to set room password")
+			return
+		}
+	}
+	if !target.appending {
+		if err := s.hub.saveRoomName(target.roomID, target.name); err != nil {
+			logger.Error("Failed to save room name", "roomId", target.roomID, "error", err)
+			s.hub.deleteRoomAudio(target.roomID)
+			respondError(c, http.StatusInternalServerError, "Failed to name room")
+			return
+		}
+	}
+	describeUpload(c, resp, target.roomID, token, tracks, totalBytes)
+
+	uploadsTotal.Add(float64(len(tracks)))
+	uploadBytesTotal.Add(float64(totalBytes))
+	logger.Info("Upload complete", "roomId", target.roomID, "tracks", len(tracks), "bytes", totalBytes, "appended", target.appending)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// describeUpload adds the URLs and details of an upload's first track to
+// resp, so that a client can start playing without building URLs or
+// fetching metadata itself. sizeBytes and durationSeconds cover every file
+// in the upload. token is the room's join token, if it has one.
+func describeUpload(c *gin.Context, resp gin.H, roomID, token string, tracks []Track, sizeBytes int64) {
+	httpBase, wsBase := requestOrigins(c)
+	query := ""
+	if token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+
+	var duration float64
+	for _, track := range tracks {
+		duration += track.Duration
+	}
+
+	resp["audioUrl"] = fmt.Sprintf("%s/audio-sync/audio/%s/%d%s", httpBase, roomID, tracks[0].Index, query)
+	resp["wsUrl"] = fmt.Sprintf("%s/audio-sync/ws/%s%s", wsBase, roomID, query)
+	resp["filename"] = tracks[0].OriginalFilename
+	resp["sha256"] = tracks[0].SHA256
+	resp["sizeBytes"] = sizeBytes
+	resp["durationSeconds"] = duration
+}
+
+// requestOrigins returns the HTTP and WebSocket origins the client reached
+// the server at. Behind a TLS-terminating proxy, X-Forwarded-Proto tells
+// them apart; a client lying in it only gets itself unusable URLs.
+func requestOrigins(c *gin.Context) (httpBase, wsBase string) {
+	if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+		return "https://" + c.Request.Host, "wss://" + c.Request.Host
+	}
+	return "http://" + c.Request.Host, "ws://" + c.Request.Host
 }
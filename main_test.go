@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds every wait for a message in these tests.
+const testTimeout = 2 * time.Second
+
+// at returns a position in seconds for Message.Time.
+func at(seconds float64) *float64 {
+	return &seconds
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer serves a fresh hub's router, as main does, for the length of
+// the test.
+func newTestServer(t *testing.T, h *Hub) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newServer(h.config, h).newRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testClient is one WebSocket connection to a test server.
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dialRoom connects to roomID on srv speaking protocolV1.
+func dialRoom(t *testing.T, srv *httptest.Server, roomID string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/audio-sync/ws/" + roomID
+	dialer := websocket.Dialer{Subprotocols: []string{protocolV1}}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		if resp != nil {
+			t.Fatalf("dial %s: %v (HTTP %d)", roomID, err, resp.StatusCode)
+		}
+		t.Fatalf("dial %s: %v", roomID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) send(msg Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// next returns the next message, or an error if none came within wait.
+func (c *testClient) next(wait time.Duration) (Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	var msg Message
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	return msg, json.Unmarshal(data, &msg)
+}
+
+// expect returns the first message of type typ, skipping any others, and
+// fails the test if none arrives in time.
+func (c *testClient) expect(typ string) Message {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		msg, err := c.next(time.Until(deadline))
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+// expectNone fails the test if a message of type typ arrives within wait.
+// The connection cannot be read from afterwards.
+func (c *testClient) expectNone(typ string, wait time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(wait)
+	for {
+		msg, err := c.next(time.Until(deadline))
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		if err != nil {
+			c.t.Fatalf("waiting out %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			c.t.Fatalf("got unexpected %s: %+v", typ, msg)
+		}
+	}
+}
+
+// expectClose skips messages until the server closes the connection, and
+// fails the test unless it does so with reason.
+func (c *testClient) expectClose(reason closeReason) {
+	c.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		_, err := c.next(time.Until(deadline))
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			c.t.Fatalf("read error %v, want close %d", err, reason.code)
+		}
+		if closeErr.Code != reason.code || closeErr.Text != reason.text() {
+			c.t.Errorf("close %d %q, want %d %q", closeErr.Code, closeErr.Text, reason.code, reason.text())
+		}
+		return
+	}
+}
+
+// expectCount waits for a user_count of want, skipping stale ones.
+func (c *testClient) expectCount(want int) {
+	c.t.Helper()
+	for c.expect(MessageUserCount).Count != want {
+	}
+}
+
+func TestPlayIsRelayedToOthersOnly(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000c1"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	listener.expectCount(2)
+	host.expectCount(2)
+
+	host.send(Message{Type: MessagePlay, Time: at(12.5)})
+
+	got := listener.expect(MessagePlay)
+	if got.Time == nil || *got.Time != 12.5 || got.RoomID != roomID {
+		t.Errorf("relayed play = %+v, want time 12.5 in room %s", got, roomID)
+	}
+	host.expectNone(MessagePlay, 300*time.Millisecond)
+}
+
+func TestUserCountFollowsJoinAndLeave(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000c2"
+
+	first := dialRoom(t, srv, roomID)
+	first.expectCount(1)
+	second := dialRoom(t, srv, roomID)
+	first.expectCount(2)
+
+	// A clean close leaves at once rather than holding the session.
+	second.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	second.conn.Close()
+	first.expectCount(1)
+}
+
+func TestMessageForAnotherRoomIsRejected(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000c3"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	host.expectCount(2)
+	listener.expectCount(2)
+
+	host.send(Message{Type: MessagePlay, RoomID: "00000000000000ff", Time: at(3)})
+	if got := host.expect(MessageError); got.Error != "message is for a different room" {
+		t.Errorf("error = %q, want the different-room error", got.Error)
+	}
+	listener.expectNone(MessagePlay, 300*time.Millisecond)
+
+	room, _ := h.lookupRoom(roomID)
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	if room.IsPlaying {
+		t.Error("room is playing after a message for another room")
+	}
+}
+
+func TestValidateRoomID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"0123456789abcdef", true},
+		{"0123456789ABCDEF", false},
+		{"0123456789abcde", false},
+		{"0123456789abcdef0", false},
+		{"../../etc/passwd", false},
+		{"..%2F..%2Fetc%2Fp", false},
+		{"*", false},
+		{"0123456789abcde*", false},
+		{"0123456789abcd[]", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validateRoomID(tt.id); got != tt.want {
+			t.Errorf("validateRoomID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestMalformedRoomIDsAreRejected(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+
+	// Escaped slashes are decoded before routing, so a traversal never
+	// reaches a handler at all; glob patterns reach one and are refused.
+	for path, want := range map[string]int{
+		"/audio-sync/audio/..%2F..%2Fetc%2Fpasswd": http.StatusNotFound,
+		"/audio-sync/ws/..%2F..%2Fetc%2Fpasswd":    http.StatusNotFound,
+		"/audio-sync/audio/*":                      http.StatusBadRequest,
+		"/audio-sync/audio/0123456789abcde*":       http.StatusBadRequest,
+		"/audio-sync/ws/*":                         http.StatusBadRequest,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+// getJSON fetches path from srv into v and returns the status.
+func getJSON(t *testing.T, srv *httptest.Server, path string, v any) int {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestListRoomsShowsWebSocketRooms(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+
+	dialRoom(t, srv, "00000000000000e2").expectCount(1)
+	first := dialRoom(t, srv, "00000000000000e1")
+	first.expectCount(1)
+	dialRoom(t, srv, "00000000000000e1").expectCount(2)
+
+	var rooms []RoomSummary
+	if status := getJSON(t, srv, "/audio-sync/api/rooms", &rooms); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if len(rooms) != 2 {
+		t.Fatalf("got %d rooms, want 2: %+v", len(rooms), rooms)
+	}
+	if rooms[0].ID != "00000000000000e1" || rooms[0].UserCount != 2 {
+		t.Errorf("rooms[0] = %+v, want room e1 with 2 users", rooms[0])
+	}
+	if rooms[1].ID != "00000000000000e2" || rooms[1].UserCount != 1 {
+		t.Errorf("rooms[1] = %+v, want room e2 with 1 user", rooms[1])
+	}
+	if rooms[0].HasAudio || rooms[1].HasAudio {
+		t.Errorf("rooms without uploads report audio: %+v", rooms)
+	}
+
+	var page []RoomSummary
+	getJSON(t, srv, "/audio-sync/api/rooms?limit=1&offset=1", &page)
+	if len(page) != 1 || page[0].ID != "00000000000000e2" {
+		t.Errorf("second page = %+v, want only room e2", page)
+	}
+	if status := getJSON(t, srv, "/audio-sync/api/rooms?limit=0", nil); status != http.StatusBadRequest {
+		t.Errorf("limit=0: status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestShutdownSendsCloseFramesAndKeepsAudio(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000f2"
+	audioPath := filepath.Join(h.config.UploadDir, roomID+".mp3")
+	if err := os.WriteFile(audioPath, []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := dialRoom(t, srv, roomID)
+	first.expectCount(1)
+	second := dialRoom(t, srv, roomID)
+	second.expectCount(2)
+
+	// As main does on SIGTERM.
+	h.shuttingDown.Store(true)
+	h.closeAllClients(closeGoingAway)
+
+	first.expectClose(closeGoingAway)
+	second.expectClose(closeGoingAway)
+
+	// The last client out of the room must not take its audio along.
+	deadline := time.Now().Add(testTimeout)
+	for {
+		_, live := h.lookupRoom(roomID)
+		if !live {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("room still open after shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(audioPath); err != nil {
+		t.Errorf("audio removed during shutdown: %v", err)
+	}
+}
+
+func TestFullRoomRefusesNextClient(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	h.config.MaxClientsPerRoom = 2
+	roomID := "00000000000000a7"
+
+	first := dialRoom(t, srv, roomID)
+	first.expectCount(1)
+	dialRoom(t, srv, roomID).expectCount(2)
+	first.expectCount(2)
+
+	dialRoom(t, srv, roomID).expectClose(closeRoomFull)
+
+	room, _ := h.lookupRoom(roomID)
+	room.mutex.RLock()
+	n := len(room.Clients)
+	room.mutex.RUnlock()
+	if n != 2 {
+		t.Errorf("room has %d clients, want 2", n)
+	}
+	first.expectNone(MessageUserCount, 300*time.Millisecond)
+}
+
+func TestClientWhoseWritesFailIsPruned(t *testing.T) {
+	h := newTestHub(t)
+	h.config.SessionGrace = 50 * time.Millisecond
+	srv := newTestServer(t, h)
+	roomID := "00000000000000a8"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	dialRoom(t, srv, roomID).expectCount(2)
+	host.expectCount(2)
+
+	// Shut the server's side of the listener's connection for writing, so
+	// the next message to it fails while its reads carry on.
+	room, _ := h.lookupRoom(roomID)
+	room.mutex.RLock()
+	var victim *Client
+	for client := range room.Clients {
+		if client != room.Host {
+			victim = client
+		}
+	}
+	room.mutex.RUnlock()
+	victim.conn.UnderlyingConn().(*net.TCPConn).CloseWrite()
+
+	host.send(Message{Type: MessagePlay, Time: at(1)})
+	host.expectCount(1)
+
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	if room.Clients[victim] {
+		t.Error("client whose write failed is still in the room")
+	}
+}
+
+func TestOversizedMessageDisconnects(t *testing.T) {
+	h := newTestHub(t)
+	h.config.MaxMessageBytes = 512
+	srv := newTestServer(t, h)
+	roomID := "00000000000000a9"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	big := dialRoom(t, srv, roomID)
+	big.expectCount(2)
+	host.expectCount(2)
+
+	big.send(Message{Type: MessageChat, Text: strings.Repeat("x", 1024)})
+	big.expectClose(closeReason{code: websocket.CloseMessageTooBig})
+
+	// Too big to be a drop, so its place is not held.
+	host.expectCount(1)
+}
+
+func TestMalformedMessageKeepsConnection(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000aa"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	listener.expectCount(2)
+
+	if err := host.conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "play",`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := host.expect(MessageError); !strings.HasPrefix(got.Error, "malformed message") {
+		t.Errorf("error = %q, want a malformed message error", got.Error)
+	}
+
+	host.send(Message{Type: MessagePlay, Time: at(4)})
+	if got := listener.expect(MessagePlay); got.Time == nil || *got.Time != 4 {
+		t.Errorf("play after a malformed message = %+v, want time 4", got)
+	}
+}
+
+func TestClientWithoutSupportedProtocolIsClosed(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/audio-sync/ws/00000000000000ab"
+
+	for _, offered := range [][]string{nil, {"audio-sync.v0"}} {
+		dialer := websocket.Dialer{Subprotocols: offered}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial offering %q: %v", offered, err)
+		}
+		client := &testClient{t: t, conn: conn}
+		client.expectClose(closeUnsupportedProtocol)
+		conn.Close()
+	}
+
+	state := dialRoom(t, srv, "00000000000000ab").expect(MessageSyncState)
+	if state.Protocol != protocolV1 {
+		t.Errorf("sync_state protocol = %q, want %q", state.Protocol, protocolV1)
+	}
+}
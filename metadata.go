@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bogem/id3v2/v2"
+	"github.com/go-audio/wav"
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// AudioMetadata describes one uploaded track. It is probed once at upload
+// time and kept in a JSON sidecar in the uploads directory (<file>.json), so
+// it survives restarts and remembers the client's original filename. Fields
+// the probe cannot determine for a format are left empty.
+type AudioMetadata struct {
+	Title            string  `json:"title"`
+	Artist           string  `json:"artist"`
+	Duration         float64 `json:"duration"` // seconds
+	Bitrate          int     `json:"bitrate"`  // bits per second
+	OriginalFilename string  `json:"originalFilename,omitempty"`
+	// SHA256 is the hex SHA-256 of the file as uploaded, which
+	// ?format=<its extension> serves even once a transcoded copy exists.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// metadataPath returns the sidecar path for the track stored as name.
+func (h *Hub) metadataPath(name string) string {
+	return filepath.Join(h.config.UploadDir, name+".json")
+}
+
+// probeAudioMetadata reads tags, duration and bitrate from the track stored
+// as name. originalFilename is used as the title when the file has no tags.
+func (h *Hub) probeAudioMetadata(name, originalFilename string) AudioMetadata {
+	var md AudioMetadata
+	if f, info, err := h.storage.Open(name); err == nil {
+		md = probeAudio(f, info.Size, filepath.Ext(name))
+		f.Close()
+	}
+	return labelAudio(md, name, originalFilename)
+}
+
+// probeAudio reads tags, duration and bitrate from f, size bytes of audio in
+// the format of extension ext, which need not be stored yet.
+func probeAudio(f io.ReadSeeker, size int64, ext string) AudioMetadata {
+	var md AudioMetadata
+	switch strings.ToLower(ext) {
+	case ".mp3":
+		probeMP3(f, &md)
+	case ".wav":
+		probeWAV(f, &md)
+	}
+	if md.Bitrate == 0 && md.Duration > 0 {
+		md.Bitrate = int(float64(size*8) / md.Duration)
+	}
+	return md
+}
+
+// labelAudio completes probed metadata for the track stored as name:
+// originalFilename is recorded, and used as the title when the file has no
+// tags.
+func labelAudio(md AudioMetadata, name, originalFilename string) AudioMetadata {
+	md.OriginalFilename = originalFilename
+	if md.Title == "" {
+		title := originalFilename
+		if title == "" {
+			title = name
+		}
+		md.Title = strings.TrimSuffix(title, filepath.Ext(title))
+	}
+	return md
+}
+
+func probeMP3(f io.ReadSeeker, md *AudioMetadata) {
+	if tag, err := id3v2.ParseReader(f, id3v2.Options{Parse: true}); err == nil {
+		md.Title = tag.Title()
+		md.Artist = tag.Artist()
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if duration, ok := mp3HeaderDuration(f); ok {
+		md.Duration = duration
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	// Without a header to go by, the decoder walks every frame.
+	dec, err := mp3.NewDecoder(f)
+	if err != nil || dec.SampleRate() == 0 {
+		return
+	}
+	// Length is in bytes of decoded 16-bit stereo PCM.
+	md.Duration = float64(dec.Length()) / 4 / float64(dec.SampleRate())
+}
+
+func probeWAV(f io.ReadSeeker, md *AudioMetadata) {
+	duration, ok := wavHeaderDuration(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	dec := wav.NewDecoder(f)
+	if !dec.IsValidFile() {
+		return
+	}
+	if ok {
+		md.Duration = duration
+	} else if duration, err := dec.Duration(); err == nil {
+		md.Duration = duration.Seconds()
+	}
+	md.Bitrate = int(dec.SampleRate) * int(dec.NumChans) * int(dec.BitDepth)
+
+	dec.ReadMetadata()
+	if dec.Metadata != nil {
+		md.Title = dec.Metadata.Title
+		md.Artist = dec.Metadata.Artist
+	}
+}
+
+func (h *Hub) saveAudioMetadata(name string, md AudioMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.metadataPath(name), data, 0644)
+}
+
+// loadAudioMetadata returns the stored metadata for the track stored as name,
+// probing the file (and saving the result) if there is no sidecar yet.
+func (h *Hub) loadAudioMetadata(name string) AudioMetadata {
+	var md AudioMetadata
+	if data, err := os.ReadFile(h.metadataPath(name)); err == nil {
+		if err := json.Unmarshal(data, &md); err == nil {
+			return md
+		}
+	}
+
+	md = h.probeAudioMetadata(name, "")
+	if err := h.saveAudioMetadata(name, md); err != nil {
+		slog.Error("Failed to save metadata", "track", name, "error", err)
+	}
+	return md
+}
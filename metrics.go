@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerHubMetrics exports gauges for the rooms and clients in h on reg.
+// They are computed at scrape time rather than maintained incrementally, so
+// they can never drift from the real state. Each hub needs its own
+// registerer: registering a second hub on the same one panics.
+func registerHubMetrics(reg prometheus.Registerer, h *Hub) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "audiosync_active_rooms",
+		Help: "Number of rooms currently registered in the hub.",
+	}, func() float64 {
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+		return float64(len(h.rooms))
+	}))
+
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "audiosync_connected_clients",
+		Help: "Number of WebSocket clients connected across all rooms.",
+	}, func() float64 {
+		total := 0
+		for _, room := range h.snapshot() {
+			room.mutex.RLock()
+			total += len(room.Clients)
+			room.mutex.RUnlock()
+		}
+		return float64(total)
+	}))
+
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "audiosync_ws_send_queue_messages",
+		Help: "Number of messages queued for WebSocket clients across all rooms.",
+	}, func() float64 {
+		total := 0
+		for _, room := range h.snapshot() {
+			room.mutex.RLock()
+			for client := range room.Clients {
+				total += len(client.send)
+			}
+			room.mutex.RUnlock()
+		}
+		return float64(total)
+	}))
+}
+
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_uploads_total",
+		Help: "Number of audio files uploaded successfully.",
+	})
+
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_upload_bytes_total",
+		Help: "Total size in bytes of audio files uploaded successfully.",
+	})
+
+	uploadsBusy = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_uploads_busy_total",
+		Help: "Number of uploads turned away because MAX_CONCURRENT_UPLOADS were already in progress.",
+	})
+
+	// messagesRelayed is only incremented for known message types, so
+	// clients cannot inflate its cardinality with made-up ones.
+	messagesRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "audiosync_messages_relayed_total",
+		Help: "Number of WebSocket messages relayed to peers, by message type.",
+	}, []string{"type"})
+
+	wsWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "audiosync_ws_write_duration_seconds",
+		Help:    "Time taken to write one message to a WebSocket client.",
+		Buckets: []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5, 10},
+	})
+
+	wsMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_ws_messages_dropped_total",
+		Help: "Number of messages dropped because a client's send queue was full.",
+	})
+
+	wsSlowDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_ws_slow_disconnects_total",
+		Help: "Number of WebSocket clients disconnected for not keeping up.",
+	})
+
+	wsMessagesRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_ws_messages_rate_limited_total",
+		Help: "Number of client messages dropped for exceeding WS_MESSAGES_PER_SECOND.",
+	})
+
+	wsWriteTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_ws_write_timeouts_total",
+		Help: "Number of WebSocket clients disconnected because a write exceeded WS_WRITE_TIMEOUT.",
+	})
+
+	pulseBytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_ws_pulse_bytes_saved_total",
+		Help: "Bytes saved by sending sync pulses as binary frames rather than JSON.",
+	})
+
+	seeksCollapsed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audiosync_seeks_collapsed_total",
+		Help: "Number of seek messages not relayed because a later message superseded them.",
+	})
+)
+
+func handleMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
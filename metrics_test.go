@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the body of a scrape of reg.
+func scrape(t *testing.T, reg *prometheus.Registry) string {
+	t.Helper()
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHubMetricsFollowRooms(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	reg := prometheus.NewRegistry()
+	registerHubMetrics(reg, h)
+
+	if body := scrape(t, reg); !strings.Contains(body, "\naudiosync_active_rooms 0\n") {
+		t.Errorf("empty hub scrape lacks audiosync_active_rooms 0:\n%s", body)
+	}
+
+	dialRoom(t, srv, "00000000000000a5").expectCount(1)
+
+	body := scrape(t, reg)
+	for _, want := range []string{"audiosync_active_rooms 1", "audiosync_connected_clients 1"} {
+		if !strings.Contains(body, "\n"+want+"\n") {
+			t.Errorf("scrape lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsEndpointIsServed(t *testing.T) {
+	srv := newTestServer(t, newTestHub(t))
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "audiosync_uploads_total") {
+		t.Errorf("GET /metrics: status %d, body lacks audiosync_uploads_total", resp.StatusCode)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Each connection may send config.WSMessageRate messages a second,
+// and as many again in a burst. Messages past that are dropped without
+// being decoded, and the client is told once each time it starts to be
+// throttled. A client that keeps it up until floodDisconnectSeconds worth
+// of messages have been dropped in a row is disconnected with 4008
+// rate_limited, and leaves the room rather than holding its session.
+//
+// Pings and pongs are control frames, which gorilla/websocket answers
+// inside ReadMessage, so they never reach the limiter.
+
+// defaultWSMessageRate is the per-connection message rate unless
+// WS_MESSAGES_PER_SECOND says otherwise. A host scrubbing sends a seek or
+// two every animation frame at most, which the seek throttle collapses.
+const defaultWSMessageRate = 20
+
+// floodDisconnectSeconds is how many seconds' allowance of messages may be
+// dropped in a row before the client is disconnected.
+const floodDisconnectSeconds = 5
+
+// errMessageFlood ends the read loop of a client disconnected for sending
+// too many messages.
+var errMessageFlood = errors.New("client sent too many messages")
+
+// messageLimiter is a connection's token bucket. Only its read loop uses it.
+type messageLimiter struct {
+	bucket tokenBucket
+	rate   float64 // tokens per second, and the burst
+	// dropped counts the messages dropped since one was last allowed.
+	dropped int
+}
+
+func newMessageLimiter(perSecond int, now time.Time) *messageLimiter {
+	return &messageLimiter{
+		bucket: tokenBucket{tokens: float64(perSecond), lastSeen: now},
+		rate:   float64(perSecond),
+	}
+}
+
+// allow takes a token for a message read at now and reports whether the
+// message may be handled.
+func (l *messageLimiter) allow(now time.Time) bool {
+	elapsed := now.Sub(l.bucket.lastSeen).Seconds()
+	l.bucket.tokens = math.Min(l.rate, l.bucket.tokens+elapsed*l.rate)
+	l.bucket.lastSeen = now
+
+	if l.bucket.tokens >= 1 {
+		l.bucket.tokens--
+		l.dropped = 0
+		return true
+	}
+	l.dropped++
+	return false
+}
+
+// flooding reports whether the client has had enough messages dropped in a
+// row to be disconnected.
+func (l *messageLimiter) flooding() bool {
+	return float64(l.dropped) >= l.rate*floodDisconnectSeconds
+}
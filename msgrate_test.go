@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageLimiter(t *testing.T) {
+	start := time.Now()
+	l := newMessageLimiter(4, start)
+
+	for i := 0; i < 4; i++ {
+		if !l.allow(start) {
+			t.Fatalf("message %d of the burst was dropped", i)
+		}
+	}
+	if l.allow(start) {
+		t.Fatal("message past the burst was allowed")
+	}
+
+	// A quarter of a second earns one message back.
+	if !l.allow(start.Add(250 * time.Millisecond)) {
+		t.Error("message after the bucket refilled was dropped")
+	}
+	if l.dropped != 0 {
+		t.Errorf("dropped = %d after an allowed message, want 0", l.dropped)
+	}
+
+	later := start.Add(250 * time.Millisecond)
+	for i := 0; i < 4*floodDisconnectSeconds; i++ {
+		if l.flooding() {
+			t.Fatalf("flooding after only %d drops", i)
+		}
+		l.allow(later)
+	}
+	if !l.flooding() {
+		t.Errorf("not flooding after %d drops in a row", l.dropped)
+	}
+}
+
+func TestFloodingClientIsThrottledThenDisconnected(t *testing.T) {
+	h := newTestHub(t)
+	h.config.WSMessageRate = 2
+	srv := newTestServer(t, h)
+	roomID := "00000000000000b4"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	flooder := dialRoom(t, srv, roomID)
+	flooder.expectCount(2)
+	host.expectCount(2)
+
+	// One past the burst is dropped with a notice...
+	for i := 0; i < 3; i++ {
+		flooder.send(Message{Type: MessagePingTime, ClientTime: 1})
+	}
+	if got := flooder.expect(MessageError); got.Error != "too many messages, some were dropped" {
+		t.Errorf("error = %q, want the throttling notice", got.Error)
+	}
+	// ...and keeping it up disconnects.
+	for i := 0; i < 2*floodDisconnectSeconds; i++ {
+		flooder.send(Message{Type: MessagePingTime, ClientTime: 1})
+	}
+	flooder.expectClose(closeRateLimited)
+
+	// A flooder leaves at once rather than holding its session.
+	host.expectCount(1)
+}
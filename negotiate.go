@@ -0,0 +1,90 @@
+package main
+
+import (
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A track can be stored in more than one format: the upload itself and,
+// once transcoded, an MP3 copy. Which one handleAudio serves is negotiated.
+// A ?format= query naming an extension ("mp3", "flac", ...) picks that
+// format outright. Otherwise the Accept header is weighed against each
+// format's content type, ties going to the more widely playable one, which
+// is also what a client sending no Accept header, or */*, gets.
+
+// chooseAudioVariant picks which of variants, most widely playable first, to
+// serve for the format query and Accept header. It reports false if none is
+// acceptable.
+func chooseAudioVariant(variants []string, format, accept string) (string, bool) {
+	if format != "" {
+		want := "." + strings.ToLower(strings.TrimPrefix(format, "."))
+		for _, name := range variants {
+			if variantExt(name) == want {
+				return name, true
+			}
+		}
+		return "", false
+	}
+
+	if strings.TrimSpace(accept) == "" {
+		return variants[0], true
+	}
+	best, bestQ := "", 0.0
+	for _, name := range variants {
+		if q := acceptQuality(accept, audioContentTypes[variantExt(name)]); q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// acceptQuality returns the q value accept gives contentType, taken from the
+// most specific media range matching it, or 0 if none does.
+func acceptQuality(accept, contentType string) float64 {
+	typ, _, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch mediaRange {
+		case contentType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		if raw, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(raw, 64); err == nil && v >= 0 && v <= 1 {
+				q = v
+			}
+		}
+	}
+	return q
+}
+
+// variantExt returns the lowercased extension of a stored track, which for a
+// transcoded copy is that of the copy.
+func variantExt(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
+
+// variantFormats lists the formats of variants for error messages.
+func variantFormats(variants []string) string {
+	formats := make([]string, len(variants))
+	for i, name := range variants {
+		formats[i] = strings.TrimPrefix(variantExt(name), ".")
+	}
+	return strings.Join(formats, ", ")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{"unset allows all", "", "https://anywhere.example", true},
+		{"wildcard allows all", "*", "https://anywhere.example", true},
+		{"listed origin", "https://a.example, https://b.example/", "https://b.example", true},
+		{"case-insensitive", "https://A.example", "https://a.EXAMPLE", true},
+		{"unlisted origin", "https://a.example", "https://evil.example", false},
+		{"scheme matters", "https://a.example", "http://a.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{AllowedOrigins: parseOrigins(tt.allowed)}
+			if got := cfg.originAllowed(tt.origin); got != tt.want {
+				t.Errorf("originAllowed(%q) with %q = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketOriginIsChecked(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	h.config.AllowedOrigins = []string{"https://a.example"}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/audio-sync/ws/00000000000000a6"
+	dialer := websocket.Dialer{Subprotocols: []string{protocolV1}}
+
+	for origin, wantOK := range map[string]bool{
+		"https://a.example":    true,
+		"https://evil.example": false,
+		"":                     true, // not a browser
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := dialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if wantOK && err != nil {
+			t.Errorf("origin %q: dial failed: %v", origin, err)
+		}
+		if !wantOK && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q: want the upgrade refused with 403, got %v", origin, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A room can also be given a password when it is created, for sharing by
+// word of mouth rather than by link. Only a bcrypt hash of it is kept, in
+// <roomID>.password.json in Storage beside the join token. Clients trade the
+// password at POST /api/room/:id/auth for an auth token, which is then
+// accepted wherever a join token is until it expires. Auth tokens are an
+// expiry time signed with the room's password hash, so nothing is stored
+// per token, they survive restarts, and they stop working if the room is
+// deleted. Rooms without a password file take no password.
+
+const (
+	// minPasswordBytes is the shortest password accepted.
+	minPasswordBytes = 4
+	// maxPasswordBytes is as much of a password as bcrypt looks at.
+	maxPasswordBytes = 72
+	// authTokenTTL is how long an auth token stays valid. It has to cover a
+	// listening session, since audio is fetched with it throughout.
+	authTokenTTL = 12 * time.Hour
+	// authAttemptsPerMinute is how many password guesses one IP may make.
+	authAttemptsPerMinute = 10
+)
+
+type roomPassword struct {
+	Hash string `json:"hash"` // bcrypt hash of the password
+}
+
+func passwordName(roomID string) string {
+	return roomID + ".password.json"
+}
+
+// validatePassword checks a password chosen for a new room.
+func validatePassword(password string) error {
+	if len(password) < minPasswordBytes {
+		return fmt.Errorf("password must be at least %d bytes", minPasswordBytes)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	return nil
+}
+
+// setRoomPassword protects roomID with password, which must have passed
+// validatePassword.
+func (h *Hub) setRoomPassword(roomID, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(roomPassword{Hash: string(hash)})
+	if err != nil {
+		return err
+	}
+	return h.storage.Save(passwordName(roomID), bytes.NewReader(data))
+}
+
+// loadPasswordHash returns the stored password hash for roomID, or nil if
+// the room has no password.
+func (h *Hub) loadPasswordHash(roomID string) []byte {
+	data, err := readStored(h.storage, passwordName(roomID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		slog.Error("Failed to read room password", "roomId", roomID, "error", err)
+		return []byte{}
+	}
+	var stored roomPassword
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Hash == "" {
+		// Fail closed, as loadTokenHash does.
+		return []byte{}
+	}
+	return []byte(stored.Hash)
+}
+
+// roomPasswordHash returns the password hash of roomID, from the hub if the
+// room is live and from storage otherwise.
+func (h *Hub) roomPasswordHash(roomID string) []byte {
+	if room, exists := h.lookupRoom(roomID); exists {
+		room.mutex.RLock()
+		defer room.mutex.RUnlock()
+		return room.PasswordHash
+	}
+	return h.loadPasswordHash(roomID)
+}
+
+// issueAuthToken returns an auth token for roomID valid until expires.
+func issueAuthToken(roomID string, passwordHash []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + hex.EncodeToString(authTokenMAC(roomID, exp, passwordHash))
+}
+
+// validAuthToken reports whether token was issued for roomID with
+// passwordHash and has not expired.
+func validAuthToken(roomID, token string, passwordHash []byte, now time.Time) bool {
+	if len(passwordHash) == 0 {
+		return false
+	}
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, authTokenMAC(roomID, exp, passwordHash))
+}
+
+func authTokenMAC(roomID, exp string, passwordHash []byte) []byte {
+	mac := hmac.New(sha256.New, passwordHash)
+	mac.Write([]byte(roomID + "." + exp))
+	return mac.Sum(nil)
+}
+
+// handleRoomAuth exchanges a room's password for an auth token.
+func (s *Server) handleRoomAuth(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	hash := s.hub.roomPasswordHash(roomID)
+	if hash == nil {
+		respondError(c, http.StatusBadRequest, "Room is not password protected")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)); err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			slog.Error("Failed to check room password", "roomId", roomID, "error", err)
+		}
+		slog.Info("Rejected room password", "roomId", roomID, "clientIp", c.ClientIP())
+		respondError(c, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+
+	expires := time.Now().Add(authTokenTTL)
+	c.JSON(http.StatusOK, gin.H{
+		"token":     issueAuthToken(roomID, hash, expires),
+		"expiresAt": expires.UTC(),
+	})
+}
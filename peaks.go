@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// Peaks summarise a track's waveform for the frontend's scrubber: the track
+// is split into peaksPoints buckets and each bucket reports the lowest and
+// highest sample in it, scaled to [-1, 1]. They are computed on first
+// request and cached in the uploads directory as <track file>.peaks.json.
+
+const (
+	// peaksPoints is the number of buckets a track is split into.
+	peaksPoints = 1000
+	// peaksSuffix is appended to a track's filename for its peaks cache.
+	peaksSuffix = ".peaks.json"
+)
+
+// errPeaksUnsupported is returned for formats peaks cannot be decoded from.
+var errPeaksUnsupported = errors.New("peaks are not supported for this format")
+
+// Peaks is the waveform summary of one track. Min and Max hold one value per
+// bucket.
+type Peaks struct {
+	Track  int       `json:"track"`
+	Points int       `json:"points"`
+	Min    []float32 `json:"min"`
+	Max    []float32 `json:"max"`
+}
+
+// peaksMu serialises peak generation, which decodes the whole track, so two
+// first requests for the same track do not both do the work. It also bounds
+// how much decoding a burst of requests can cause.
+var peaksMu sync.Mutex
+
+func (s *Server) handlePeaks(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+
+	index, err := strconv.Atoi(c.DefaultQuery("track", "0"))
+	if err != nil || index < 0 {
+		respondError(c, http.StatusBadRequest, "Invalid track index")
+		return
+	}
+
+	name, ok := s.hub.findTrackAudio(roomID, index)
+	if !ok {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+
+	peaks, err := s.hub.loadPeaks(name)
+	if errors.Is(err, errPeaksUnsupported) {
+		respondError(c, http.StatusNotImplemented, "Peaks are only available for MP3 and WAV tracks")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to compute peaks", "roomId", roomID, "track", name, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to decode audio")
+		return
+	}
+	peaks.Track = index
+
+	c.JSON(http.StatusOK, peaks)
+}
+
+// loadPeaks returns the cached peaks for the track stored as name, computing
+// and caching them first if needed.
+func (h *Hub) loadPeaks(name string) (Peaks, error) {
+	peaksMu.Lock()
+	defer peaksMu.Unlock()
+
+	var peaks Peaks
+	cache := filepath.Join(h.config.UploadDir, name+peaksSuffix)
+	if data, err := os.ReadFile(cache); err == nil {
+		if err := json.Unmarshal(data, &peaks); err == nil {
+			return peaks, nil
+		}
+	}
+
+	peaks, err := h.computePeaks(name)
+	if err != nil {
+		return Peaks{}, err
+	}
+	if data, err := json.Marshal(peaks); err == nil {
+		if err := os.WriteFile(cache, data, 0644); err != nil {
+			slog.Error("Failed to cache peaks", "path", cache, "error", err)
+		}
+	}
+	return peaks, nil
+}
+
+func (h *Hub) computePeaks(name string) (Peaks, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != ".mp3" && ext != ".wav" {
+		return Peaks{}, errPeaksUnsupported
+	}
+
+	f, _, err := h.storage.Open(name)
+	if err != nil {
+		return Peaks{}, err
+	}
+	defer f.Close()
+
+	switch ext {
+	case ".mp3":
+		return mp3Peaks(f)
+	case ".wav":
+		return wavPeaks(f)
+	}
+	return Peaks{}, errPeaksUnsupported
+}
+
+// peakBuilder folds a stream of samples into peaksPoints min/max buckets.
+type peakBuilder struct {
+	perBucket int64 // samples per bucket
+	seen      int64 // samples in the current bucket
+	min, max  float32
+	peaks     Peaks
+}
+
+func newPeakBuilder(totalSamples int64) *peakBuilder {
+	perBucket := (totalSamples + peaksPoints - 1) / peaksPoints
+	if perBucket < 1 {
+		perBucket = 1
+	}
+	return &peakBuilder{perBucket: perBucket}
+}
+
+func (b *peakBuilder) add(v float32) {
+	if b.seen == 0 || v < b.min {
+		b.min = v
+	}
+	if b.seen == 0 || v > b.max {
+		b.max = v
+	}
+	b.seen++
+	if b.seen == b.perBucket {
+		b.flush()
+	}
+}
+
+func (b *peakBuilder) flush() {
+	if b.seen == 0 {
+		return
+	}
+	b.peaks.Min = append(b.peaks.Min, b.min)
+	b.peaks.Max = append(b.peaks.Max, b.max)
+	b.seen = 0
+}
+
+func (b *peakBuilder) result() Peaks {
+	b.flush()
+	b.peaks.Points = len(b.peaks.Min)
+	return b.peaks
+}
+
+// mp3Peaks decodes r, which go-mp3 always turns into 16-bit little-endian
+// stereo PCM.
+func mp3Peaks(r io.Reader) (Peaks, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return Peaks{}, err
+	}
+
+	b := newPeakBuilder(dec.Length() / 2)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := io.ReadFull(dec, buf)
+		for i := 0; i+1 < n; i += 2 {
+			sample := int16(binary.LittleEndian.Uint16(buf[i:]))
+			b.add(float32(sample) / math.MaxInt16)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Peaks{}, err
+		}
+	}
+	return b.result(), nil
+}
+
+func wavPeaks(r io.ReadSeeker) (Peaks, error) {
+	dec := wav.NewDecoder(r)
+	if !dec.IsValidFile() {
+		return Peaks{}, errPeaksUnsupported
+	}
+	if err := dec.FwdToPCM(); err != nil {
+		return Peaks{}, err
+	}
+
+	bitDepth := int(dec.BitDepth)
+	if bitDepth == 0 {
+		return Peaks{}, errPeaksUnsupported
+	}
+	// 8-bit WAV samples are unsigned; wider ones are signed.
+	offset := 0
+	scale := float32(int64(1) << (bitDepth - 1))
+	if bitDepth == 8 {
+		offset = 128
+	}
+
+	b := newPeakBuilder(dec.PCMLen() / int64((bitDepth+7)/8))
+	buf := &audio.IntBuffer{Data: make([]int, 16<<10)}
+	for {
+		n, err := dec.PCMBuffer(buf)
+		if err != nil {
+			return Peaks{}, err
+		}
+		if n == 0 {
+			break
+		}
+		for _, sample := range buf.Data[:n] {
+			b.add(float32(sample-offset) / scale)
+		}
+	}
+	return b.result(), nil
+}
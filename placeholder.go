@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A room created without audio has nothing for /audio/:id to serve, and a
+// player pointed there shows an error. With PLACEHOLDER_AUDIO naming a local
+// audio file, such a room serves that file instead, marked with an
+// X-Audio-Placeholder: true header, and /api/room/:id, /api/room/:id/state
+// and the welcome message report placeholder: true so that a page can say
+// there is no audio yet. The file is served uncached, so a player picks up
+// the real track as soon as one is uploaded.
+//
+// Only a room that is live and has no tracks at all gets the placeholder;
+// a track missing from a room that has others is still a 404.
+
+// placeholderHeader marks a response carrying the placeholder.
+const placeholderHeader = "X-Audio-Placeholder"
+
+// checkPlaceholderAudio returns path if it names a readable file of an
+// accepted audio type, and otherwise logs why not and returns "".
+func checkPlaceholderAudio(path string) string {
+	if path == "" {
+		return ""
+	}
+	if _, ok := audioContentTypes[strings.ToLower(filepath.Ext(path))]; !ok {
+		slog.Warn("Ignoring PLACEHOLDER_AUDIO, not an accepted audio type", "path", path, "accepted", acceptedExtensions)
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		slog.Warn("Ignoring PLACEHOLDER_AUDIO, not a readable file", "path", path, "error", err)
+		return ""
+	}
+	slog.Info("Serving placeholder audio for rooms without tracks", "path", path)
+	return path
+}
+
+// usesPlaceholder reports whether roomID is a live room with no tracks that
+// the placeholder stands in for.
+func (h *Hub) usesPlaceholder(roomID string) bool {
+	if h.config.PlaceholderAudio == "" {
+		return false
+	}
+	if _, live := h.lookupRoom(roomID); !live {
+		return false
+	}
+	return len(h.listTracks(roomID)) == 0
+}
+
+// servePlaceholderAudio serves the placeholder file.
+func (s *Server) servePlaceholderAudio(c *gin.Context) {
+	file, err := os.Open(s.config.PlaceholderAudio)
+	if err != nil {
+		slog.Error("Failed to open placeholder audio", "path", s.config.PlaceholderAudio, "error", err)
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "Failed to read audio file")
+		return
+	}
+
+	c.Header(placeholderHeader, "true")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Type", audioContentTypes[strings.ToLower(filepath.Ext(s.config.PlaceholderAudio))])
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"time"
+)
+
+// A room's tracks live next to each other in the uploads directory. The first
+// track keeps the original single-file name, <roomID><ext>, and later tracks
+// are stored as <roomID>.<index><ext>, so every file belonging to a room
+// still matches <roomID>.*. The files themselves are kept in storage, while
+// each track's metadata sidecar is in the uploads directory as
+// <track file>.json.
+
+type Track struct {
+	Index    int    `json:"index"`
+	Filename string `json:"filename"`
+	AudioMetadata
+}
+
+func trackFilename(roomID string, index int, ext string) string {
+	if index == 0 {
+		return roomID + ext
+	}
+	return fmt.Sprintf("%s.%d%s", roomID, index, ext)
+}
+
+// parseTrackFilename is the inverse of trackFilename.
+func parseTrackFilename(name string) (roomID string, index int, ok bool) {
+	parts := strings.Split(name, ".")
+	switch len(parts) {
+	case 2:
+		roomID = parts[0]
+	case 3:
+		roomID = parts[0]
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return "", 0, false
+		}
+		index = n
+	default:
+		return "", 0, false
+	}
+	if !validateRoomID(roomID) {
+		return "", 0, false
+	}
+	return roomID, index, true
+}
+
+// uploadRoomID returns the room an uploads directory entry belongs to, be it
+// a track or any of the files kept beside it (metadata, peaks, transcoded
+// copies). Every such file is named <roomID>.<something>.
+func uploadRoomID(name string) (string, bool) {
+	roomID, _, found := strings.Cut(name, ".")
+	if !found || !validateRoomID(roomID) {
+		return "", false
+	}
+	return roomID, true
+}
+
+// loadPlaylist lists the tracks stored for roomID in index order, along with
+// their metadata.
+func (h *Hub) loadPlaylist(roomID string) []Track {
+	tracks := h.listTracks(roomID)
+	for i := range tracks {
+		tracks[i].AudioMetadata = h.loadAudioMetadata(tracks[i].Filename)
+	}
+	return tracks
+}
+
+// listTracks is loadPlaylist without the metadata, for callers that only
+// need to find files.
+func (h *Hub) listTracks(roomID string) []Track {
+	files, err := h.storage.List(roomID + ".")
+	if err != nil {
+		slog.Error("Failed to look up audio", "roomId", roomID, "error", err)
+		return nil
+	}
+
+	var tracks []Track
+	for _, file := range files {
+		id, index, ok := parseTrackFilename(file.Name)
+		if !ok || id != roomID {
+			continue
+		}
+		tracks = append(tracks, Track{Index: index, Filename: file.Name})
+	}
+
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].Index < tracks[j].Index
+	})
+	return tracks
+}
+
+// findTrackAudio returns the file name of track index in roomID's playlist.
+func (h *Hub) findTrackAudio(roomID string, index int) (string, bool) {
+	for _, track := range h.listTracks(roomID) {
+		if track.Index == index {
+			return track.Filename, true
+		}
+	}
+	return "", false
+}
+
+// nextTrackIndex returns the index the next uploaded track for roomID should
+// use. The caller must hold playlistMu.
+func (h *Hub) nextTrackIndex(roomID string) int {
+	tracks := h.listTracks(roomID)
+	if len(tracks) == 0 {
+		return 0
+	}
+	return tracks[len(tracks)-1].Index + 1
+}
+
+// appendTracks adds newly uploaded tracks to a live room's playlist and tells
+// its clients about the change.
+func (h *Hub) appendTracks(roomID string, tracks []Track) {
+	room, exists := h.lookupRoom(roomID)
+	if !exists {
+		return
+	}
+
+	room.mutex.Lock()
+	room.Playlist = append(room.Playlist, tracks...)
+	playlist := append([]Track(nil), room.Playlist...)
+	room.mutex.Unlock()
+	persistRoom(room)
+
+	room.Broadcast(Message{
+		Type:     MessagePlaylist,
+		RoomID:   roomID,
+		Playlist: playlist,
+	}, nil)
+}
+
+// changeTrack applies a next, prev or selectTrack message to the room,
+// rewinding to the start of the chosen track. On success msg.Track and
+// msg.Time are set to the new position so the message can be relayed as is.
+func changeTrack(room *Room, msg *Message) error {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if err := checkSeq(room, msg); err != nil {
+		return err
+	}
+
+	target := room.CurrentTrack
+	switch msg.Type {
+	case MessageNext:
+		target++
+	case MessagePrev:
+		target--
+	case MessageSelectTrack:
+		target = msg.Track
+	}
+
+	if target < 0 || target >= len(room.Playlist) {
+		return fmt.Errorf("no track at position %d", target)
+	}
+
+	room.CurrentTrack = target
+	room.CurrentTime = 0
+	room.LastUpdate = time.Now()
+	room.Seeking = false
+	dropHeldSeek(room)
+
+	msg.Track = target
+	msg.Time = new(float64)
+	msg.IsPlaying = room.IsPlaying
+	msg.Seq = bumpSeq(room)
+	msg.ServerTime = serverNow()
+	return nil
+}
+
+// endTrack moves the room on from a track that has finished playing: to the
+// start of the next track if there is one, still playing, and otherwise
+// back to the start of the finished track, paused, so late joiners do not
+// find a room "playing" past the end. It does nothing and returns false
+// unless msg.Track is the current one and msg is not stale, so a late or
+// repeated report cannot skip a track. The returned message tells clients
+// where the room is now.
+func endTrack(room *Room, msg *Message) (Message, bool) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if msg.Track != room.CurrentTrack || checkSeq(room, msg) != nil {
+		return Message{}, false
+	}
+	return endCurrentTrack(room), true
+}
+
+// endCurrentTrack is endTrack for the current track. The caller must hold
+// room.mutex.
+func endCurrentTrack(room *Room) Message {
+	if room.CurrentTrack+1 < len(room.Playlist) {
+		room.CurrentTrack++
+		room.IsPlaying = true
+	} else {
+		room.IsPlaying = false
+	}
+	room.CurrentTime = 0
+	room.LastUpdate = time.Now()
+	room.Seeking = false
+	dropHeldSeek(room)
+
+	return Message{
+		Type:       MessagePlaybackEnded,
+		RoomID:     room.ID,
+		Track:      room.CurrentTrack,
+		IsPlaying:  room.IsPlaying,
+		Seq:        bumpSeq(room),
+		ServerTime: serverNow(),
+	}
+}
+
+// removeOrphanedAudio deletes the tracks, and their metadata, written by a
+// failed multi-file upload.
+func (h *Hub) removeOrphanedAudio(names []string) {
+	for _, name := range names {
+		h.storage.Delete(name)
+		os.Remove(h.metadataPath(name))
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "slices"
+
+// The WebSocket message protocol is versioned through the WebSocket
+// subprotocol. A client lists the versions it speaks in
+// Sec-WebSocket-Protocol, the upgrade picks the one the server prefers
+// among them, and welcome and sync_state report it as protocol. A client
+// offering none the server supports, including one offering no subprotocol
+// at all, is closed with 4007 unsupported_protocol as soon as it connects,
+// rather than left to misread messages it does not understand.
+//
+// A change old clients would misread gets a new version, served alongside
+// the old ones for as long as they are in use. A variant of a version,
+// such as audio-sync.v1.binary in binary.go, is preferred to the version
+// itself, since a client only offers it if it can use it.
+
+// protocolV1 is the message protocol as it stands.
+const protocolV1 = "audio-sync.v1"
+
+// supportedProtocols are the protocol versions the server speaks, the
+// preferred one first.
+var supportedProtocols = []string{protocolV1Binary, protocolV1}
+
+func supportsProtocol(protocol string) bool {
+	return slices.Contains(supportedProtocols, protocol)
+}
@@ -0,0 +1,79 @@
+package main
+
+import "time"
+
+// While a room is playing, the server periodically sends every client a
+// sync_pulse carrying the authoritative position and the server time it was
+// taken at. Clients compare it with where their player actually is and
+// correct themselves once the drift passes their own threshold. Paused and
+// empty rooms get no pulses, since there is nothing to drift from, and nor
+// do rooms whose host is scrubbing, since the position is about to change.
+//
+// The same tick ends tracks that have played past their duration, in case
+// the host is gone or never reports the end itself.
+
+// defaultSyncPulseInterval is how often playing rooms are pulsed unless
+// SYNC_PULSE_INTERVAL says otherwise.
+const defaultSyncPulseInterval = 5 * time.Second
+
+// trackEndGrace is how long past a track's duration the server waits for
+// the host to report the end before ending the track itself.
+const trackEndGrace = 2 * time.Second
+
+// runSyncPulse sends a sync pulse to every playing room each interval. It
+// never returns.
+func runSyncPulse(hub *Hub, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		hub.pulseRooms()
+	}
+}
+
+// pulseRooms sends a sync pulse to each room that is playing and has
+// clients, after ending any track that has run out.
+func (h *Hub) pulseRooms() {
+	for _, room := range h.snapshot() {
+		if ended, ok := endFinishedTrack(room); ok {
+			persistRoom(room)
+			room.Broadcast(ended, nil)
+		}
+
+		room.mutex.RLock()
+		playing := room.IsPlaying && !room.Seeking && len(room.Clients) > 0
+		position := currentPosition(room)
+		msg := Message{
+			Type:       MessageSyncPulse,
+			RoomID:     room.ID,
+			Time:       &position,
+			IsPlaying:  room.IsPlaying,
+			Track:      room.CurrentTrack,
+			Seq:        room.Seq,
+			ServerTime: serverNow(),
+		}
+		room.mutex.RUnlock()
+
+		if playing {
+			room.Broadcast(msg, nil)
+		}
+	}
+}
+
+// endFinishedTrack ends the room's current track if it is playing and has
+// passed its duration by trackEndGrace, unless the host is scrubbing.
+// Tracks of unknown duration, such as remote ones, are left for the host to
+// end.
+func endFinishedTrack(room *Room) (Message, bool) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if !room.IsPlaying || room.Seeking || room.CurrentTrack >= len(room.Playlist) {
+		return Message{}, false
+	}
+	duration := room.Playlist[room.CurrentTrack].Duration
+	if duration <= 0 || currentPosition(room) < duration+trackEndGrace.Seconds() {
+		return Message{}, false
+	}
+	return endCurrentTrack(room), true
+}
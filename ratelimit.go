@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultUploadsPerMinute is how many uploads a single IP may make per
+// minute unless UPLOADS_PER_MINUTE says otherwise.
+const defaultUploadsPerMinute = 5
+
+const (
+	// limiterEvictInterval is how often idle buckets are swept.
+	limiterEvictInterval = 5 * time.Minute
+	// limiterIdleTTL is how long a bucket may go unused before it is
+	// dropped. A bucket idle this long has refilled anyway.
+	limiterIdleTTL = 10 * time.Minute
+)
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per-key token bucket. Each key may burst up to perMinute
+// requests and then refills at perMinute per minute.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	burst   float64
+	rate    float64 // tokens per second
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		burst:   float64(perMinute),
+		rate:    float64(perMinute) / 60,
+	}
+}
+
+// allow takes a token from key's bucket. When the bucket is empty it reports
+// how long until the next token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst}
+		l.buckets[key] = bucket
+	} else {
+		elapsed := now.Sub(bucket.lastSeen).Seconds()
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := (1 - bucket.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// evictIdle drops buckets that have not been used since before cutoff.
+func (l *rateLimiter) evictIdle(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, bucket := range l.buckets {
+		if bucket.lastSeen.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// runEviction periodically sweeps idle buckets so the map does not grow with
+// every IP ever seen. It never returns.
+func (l *rateLimiter) runEviction(interval, idleTTL time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.evictIdle(time.Now().Add(-idleTTL))
+	}
+}
+
+// rateLimitMiddleware rejects requests with 429 once the client IP has used
+// up its bucket.
+func rateLimitMiddleware(l *rateLimiter, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, retryAfter := l.allow(c.ClientIP())
+		if !ok {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			abortError(c, http.StatusTooManyRequests, message)
+			return
+		}
+		c.Next()
+	}
+}
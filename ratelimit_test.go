@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The rate limiters key on c.ClientIP, so it must only follow forwarding
+// headers from trusted proxies.
+func TestClientIPFromForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		header  string
+		value   string
+		want    string
+	}{
+		{"untrusted proxy", nil, "X-Forwarded-For", "203.0.113.7", "127.0.0.1"},
+		{"trusted proxy", []string{"127.0.0.1"}, "X-Forwarded-For", "203.0.113.7", "203.0.113.7"},
+		{"trusted range", []string{"127.0.0.0/8"}, "X-Forwarded-For", "198.51.100.2, 203.0.113.7", "203.0.113.7"},
+		{"trusted, X-Real-IP", []string{"127.0.0.1"}, "X-Real-IP", "203.0.113.8", "203.0.113.8"},
+		{"other proxy trusted", []string{"10.0.0.1"}, "X-Forwarded-For", "203.0.113.7", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(t)
+			h.config.TrustedProxies = tt.proxies
+			router := newServer(h.config, h).newRouter()
+			router.GET("/test/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+			req := httptest.NewRequest(http.MethodGet, "/test/ip", nil)
+			req.RemoteAddr = "127.0.0.1:40000"
+			req.Header.Set(tt.header, tt.value)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The host can hold playback until everyone has buffered. It sends a
+// ready_check, which goes to every connected client following the host,
+// the host included, and each answers ready once its player can play
+// through. Every ready is relayed to the room with how many of how many
+// are ready, so the host can watch the count. Once everyone asked is
+// ready, or when readyCheckTimeout runs out with more than half of them
+// ready, the server starts playback readyStartDelay from now and broadcasts
+// start with that moment as startAt, on the clock of /api/time, for every
+// player to wait for. Without a majority by then it gives up with
+// ready_check_failed, leaving playback as it was.
+//
+// Clients that join during the check are not waited for, and ones that
+// leave or drop stop counting. Any other change to the playback state in
+// the meantime, the host pressing play or seeking say, calls the check off.
+
+const (
+	// readyCheckTimeout is how long clients have to answer a ready check.
+	readyCheckTimeout = 10 * time.Second
+	// readyStartDelay is how far ahead a ready check schedules the start,
+	// long enough for the start message to reach everyone first.
+	readyStartDelay = time.Second
+)
+
+// readyCheck is a room's ready check in progress, guarded by room.mutex.
+type readyCheck struct {
+	// asked are the clients waited for, each true once it is ready.
+	asked map[*Client]bool
+	// seq is the room's Seq when the check began.
+	seq   uint64
+	timer *time.Timer
+}
+
+var (
+	errNoReadyCheck = errors.New("there is no ready check in progress")
+	errNotAsked     = errors.New("you are not part of this ready check")
+)
+
+// handleReadyCheck starts a ready check, replacing any already running.
+func handleReadyCheck(room *Room, sender *Client, msg *Message) error {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if err := checkSeq(room, msg); err != nil {
+		return err
+	}
+	if room.readyCheck != nil {
+		room.readyCheck.timer.Stop()
+	}
+	check := &readyCheck{asked: make(map[*Client]bool), seq: room.Seq}
+	for client := range room.Clients {
+		if connectedFollower(room, client) {
+			check.asked[client] = false
+		}
+	}
+	check.timer = time.AfterFunc(readyCheckTimeout, func() { expireReadyCheck(room, check) })
+	room.readyCheck = check
+
+	sender.logger.Info("Ready check started", "clients", len(check.asked))
+	room.broadcastLocked(Message{
+		Type:      MessageReadyCheck,
+		RoomID:    room.ID,
+		UserCount: len(check.asked),
+	}, nil)
+	return nil
+}
+
+// handleReady records the sender as ready, starting playback if it was the
+// last one the check was waiting for.
+func handleReady(room *Room, sender *Client, msg *Message) error {
+	room.mutex.Lock()
+	check := room.readyCheck
+	if check == nil {
+		room.mutex.Unlock()
+		return errNoReadyCheck
+	}
+	if _, ok := check.asked[sender]; !ok {
+		room.mutex.Unlock()
+		return errNotAsked
+	}
+	check.asked[sender] = true
+
+	ready, total := check.count(room)
+	room.broadcastLocked(Message{
+		Type:      MessageReady,
+		RoomID:    room.ID,
+		ClientID:  sender.ID,
+		Count:     ready,
+		UserCount: total,
+	}, nil)
+	started := ready == total && finishReadyCheck(room, check, true)
+	room.mutex.Unlock()
+
+	if started {
+		persistRoom(room)
+	}
+	return nil
+}
+
+// expireReadyCheck ends check once its clients have run out of time,
+// starting playback if a majority of them are ready.
+func expireReadyCheck(room *Room, check *readyCheck) {
+	room.mutex.Lock()
+	if room.readyCheck != check {
+		room.mutex.Unlock()
+		return
+	}
+	ready, total := check.count(room)
+	started := finishReadyCheck(room, check, 2*ready > total)
+	room.mutex.Unlock()
+
+	if started {
+		persistRoom(room)
+	}
+}
+
+// count returns how many of the clients asked are ready, out of those still
+// connected to the room. The caller must hold room.mutex.
+func (check *readyCheck) count(room *Room) (ready, total int) {
+	for client, isReady := range check.asked {
+		if !room.Clients[client] || !connectedFollower(room, client) {
+			continue
+		}
+		total++
+		if isReady {
+			ready++
+		}
+	}
+	return ready, total
+}
+
+// finishReadyCheck ends check, starting playback if start is set and the
+// playback state has not moved on since the check began, and telling the
+// room either way. It reports whether playback was started. The caller
+// must hold room.mutex.
+func finishReadyCheck(room *Room, check *readyCheck, start bool) bool {
+	check.timer.Stop()
+	room.readyCheck = nil
+
+	failed := Message{Type: MessageReadyCheckFailed, RoomID: room.ID}
+	switch {
+	case room.Seq != check.seq:
+		failed.Error = "playback changed during the ready check"
+	case !start:
+		ready, total := check.count(room)
+		failed.Error = fmt.Sprintf("only %d of %d clients were ready", ready, total)
+		failed.Count, failed.UserCount = ready, total
+	default:
+		room.broadcastLocked(scheduleStart(room), nil)
+		return true
+	}
+	room.broadcastLocked(failed, nil)
+	return false
+}
+
+// scheduleStart sets the room playing from readyStartDelay from now and
+// returns the start message telling clients so. The caller must hold
+// room.mutex.
+func scheduleStart(room *Room) Message {
+	position := currentPosition(room)
+	if room.IsPlaying {
+		position += readyStartDelay.Seconds()
+	}
+	room.Seeking = false
+	room.IsPlaying = true
+	room.CurrentTime = position
+	// currentPosition holds at CurrentTime until then.
+	room.LastUpdate = time.Now().Add(readyStartDelay)
+	dropHeldSeek(room)
+
+	return Message{
+		Type:       MessageStart,
+		RoomID:     room.ID,
+		Time:       &position,
+		IsPlaying:  true,
+		Track:      room.CurrentTrack,
+		Seq:        bumpSeq(room),
+		ServerTime: serverNow(),
+		StartAt:    serverNow() + readyStartDelay.Milliseconds(),
+	}
+}
+
+// connectedFollower reports whether client is following the host on a live
+// connection, and so would be sent a ready check. The caller must hold
+// room.mutex.
+func connectedFollower(room *Room, client *Client) bool {
+	if skipsMessage(client, MessageReadyCheck) {
+		return false
+	}
+	d, ok := room.detached[client.session]
+	return !ok || d.client != client
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A room can play audio hosted elsewhere instead of an upload. The remote
+// track is stored like any other track, as <roomID><remoteAudioExt> holding
+// just the URL, so it is listed, expired and deleted along with the room.
+//
+// handleAudio proxies remote tracks rather than redirecting to them. That
+// keeps the origin hidden from listeners, lets Range requests through so
+// seeking works, and stops browsers from caching a redirect to a URL the
+// room may later stop using.
+
+const (
+	remoteAudioExt = ".url"
+	// remoteCheckTimeout bounds the HEAD request made when a remote track
+	// is added.
+	remoteCheckTimeout = 10 * time.Second
+)
+
+// errPrivateAddress is returned when a remote URL resolves to an address on
+// the server's own network, which listeners must not be able to reach
+// through the proxy.
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// remoteClient fetches remote tracks. Redirects are followed through the
+// same dialer, so they cannot be used to reach a private address either.
+var remoteClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: remoteCheckTimeout,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+		ResponseHeaderTimeout: remoteCheckTimeout,
+	},
+}
+
+// nonPublicPrefixes are the ranges rejectPrivateAddress refuses that netip
+// has no predicate for: carrier-grade NAT, which cloud providers also use
+// internally, and "this network", which Linux dials as the local host.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("0.0.0.0/8"),
+}
+
+// rejectPrivateAddress is a net.Dialer Control hook refusing loopback,
+// private, link-local, carrier-grade NAT and unspecified addresses. It runs
+// after DNS resolution, so a public hostname pointing at an internal address
+// is refused too.
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	// An IPv4-mapped IPv6 address reaches the same host as the IPv4 one.
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errPrivateAddress
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+func isRemoteTrack(name string) bool {
+	return strings.HasSuffix(name, remoteAudioExt)
+}
+
+// readRemoteURL returns the URL held by the remote track stored as name.
+func (h *Hub) readRemoteURL(name string) (string, error) {
+	f, _, err := h.storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, 8<<10))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// checkRemoteAudio makes sure rawURL is an http(s) URL that answers a HEAD
+// request with an audio content type.
+func checkRemoteAudio(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL must be an absolute http or https URL")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("URL is not reachable: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("URL returned status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "audio/") && mediaType != "application/ogg" {
+		return fmt.Errorf("URL does not point to audio (Content-Type %q)", mediaType)
+	}
+	return nil
+}
+
+// saveRemoteTrack stores rawURL as track index of roomID. The caller must
+// hold playlistMu.
+func (h *Hub) saveRemoteTrack(roomID string, index int, rawURL string) (Track, error) {
+	filename := trackFilename(roomID, index, remoteAudioExt)
+	if err := h.storage.Save(filename, strings.NewReader(rawURL)); err != nil {
+		return Track{}, err
+	}
+
+	u, _ := url.Parse(rawURL)
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = u.Host
+	}
+	// Only the file name is kept in the metadata, which is public, so that
+	// the proxy does not give away the origin.
+	md := AudioMetadata{
+		Title:            strings.TrimSuffix(name, path.Ext(name)),
+		OriginalFilename: name,
+	}
+	if err := h.saveAudioMetadata(filename, md); err != nil {
+		slog.Error("Failed to save metadata", "track", filename, "error", err)
+	}
+	return Track{Index: index, Filename: filename, AudioMetadata: md}, nil
+}
+
+// serveRemoteAudio streams the remote track stored as name, passing the
+// client's Range headers through so that seeking works.
+func (s *Server) serveRemoteAudio(c *gin.Context, name string) {
+	rawURL, err := s.hub.readRemoteURL(name)
+	if err != nil {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, rawURL, nil)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, "Failed to fetch remote audio")
+		return
+	}
+	for _, header := range []string{"Range", "If-Range"} {
+		if v := c.GetHeader(header); v != "" {
+			req.Header.Set(header, v)
+		}
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		slog.Warn("Failed to fetch remote audio", "track", name, "error", err)
+		respondError(c, http.StatusBadGateway, "Failed to fetch remote audio")
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		respondError(c, http.StatusBadGateway, fmt.Sprintf("Remote audio returned status %d", resp.StatusCode))
+		return
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"} {
+		if v := resp.Header.Get(header); v != "" {
+			c.Header(header, v)
+		}
+	}
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
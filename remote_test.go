@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestRejectPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1::1]:443", false},
+		{"100.63.255.255:80", false},
+		{"100.128.0.1:80", false},
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.1.2.3:80", true},
+		{"172.16.0.1:80", true},
+		{"192.168.1.1:80", true},
+		{"[fd00::1]:80", true},
+		{"169.254.169.254:80", true},
+		{"[fe80::1%eth0]:80", true},
+		{"100.64.0.1:80", true},
+		{"100.127.255.254:80", true},
+		{"0.0.0.0:80", true},
+		{"0.1.2.3:80", true},
+		{"[::]:80", true},
+		{"[::ffff:127.0.0.1]:80", true},
+		{"[::ffff:100.64.0.1]:80", true},
+	}
+	for _, tt := range tests {
+		err := rejectPrivateAddress("tcp", tt.address, nil)
+		if refused := err == errPrivateAddress; refused != tt.refused {
+			t.Errorf("rejectPrivateAddress(%q) = %v, want refused %v", tt.address, err, tt.refused)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /api/room/:id/metrics breaks the server-wide message metrics down for a
+// single live room: its lifetime stats from stats.go, how many users it has
+// now, and how many broadcasts it has fanned out to how many clients. Like
+// the history, it is for the room's host or an operator with the admin
+// token.
+//
+// Broadcasts are counted with atomics rather than under room.mutex, since
+// they are sent holding it only for reading. Unlike the stats they are not
+// saved, so they start over when the server restarts.
+
+// fanoutCounters count a room's broadcasts and the client messages they
+// turned into.
+type fanoutCounters struct {
+	broadcasts atomic.Int64
+	deliveries atomic.Int64
+}
+
+// count records a broadcast sent to sent clients.
+func (f *fanoutCounters) count(sent int) {
+	f.broadcasts.Add(1)
+	f.deliveries.Add(int64(sent))
+}
+
+// RoomMetrics is the body of /api/room/:id/metrics.
+type RoomMetrics struct {
+	RoomID string `json:"roomId"`
+	Users  int    `json:"users"`
+	RoomStats
+	Broadcasts int64 `json:"broadcasts"`
+	// Deliveries is how many clients the broadcasts reached, in total.
+	Deliveries int64 `json:"deliveries"`
+}
+
+func (s *Server) handleRoomMetrics(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	room, exists := s.hub.lookupRoom(roomID)
+	if !exists {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+	if !s.requireHostOrAdmin(c, room, "Only the room's host can read its metrics") {
+		return
+	}
+
+	room.mutex.RLock()
+	metrics := RoomMetrics{
+		RoomID:    roomID,
+		Users:     len(room.Clients),
+		RoomStats: room.Stats.snapshot(),
+	}
+	room.mutex.RUnlock()
+	metrics.Broadcasts = room.fanout.broadcasts.Load()
+	metrics.Deliveries = room.fanout.deliveries.Load()
+
+	c.JSON(http.StatusOK, metrics)
+}
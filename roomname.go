@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A room can carry a display name beside its opaque ID. It is chosen when
+// the room is created and the host can change it with a rename message,
+// which everyone is told about in room_renamed. Like the password, the name
+// is kept in a sidecar, <id>.name.json, so it is there for rooms nobody has
+// joined yet and survives restarts.
+
+// maxRoomNameLength is the longest room name accepted, in characters.
+const maxRoomNameLength = 64
+
+type storedRoomName struct {
+	Name string `json:"name"`
+}
+
+func (h *Hub) roomNamePath(roomID string) string {
+	return filepath.Join(h.config.UploadDir, roomID+".name.json")
+}
+
+// cleanRoomName strips control characters and surrounding space from name
+// and checks its length. Tabs and line breaks become spaces rather than
+// joining words. An empty result means no name.
+func cleanRoomName(name string) (string, error) {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name))
+	if utf8.RuneCountInString(name) > maxRoomNameLength {
+		return "", fmt.Errorf("room name is longer than %d characters", maxRoomNameLength)
+	}
+	return name, nil
+}
+
+// saveRoomName stores name, which must have passed cleanRoomName, as
+// roomID's name. An empty name removes it.
+func (h *Hub) saveRoomName(roomID, name string) error {
+	if name == "" {
+		err := os.Remove(h.roomNamePath(roomID))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(storedRoomName{Name: name})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.roomNamePath(roomID), data, 0644)
+}
+
+// loadRoomName returns roomID's stored name, or "" if it has none.
+func (h *Hub) loadRoomName(roomID string) string {
+	data, err := os.ReadFile(h.roomNamePath(roomID))
+	if err != nil {
+		return ""
+	}
+	var stored storedRoomName
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ""
+	}
+	return stored.Name
+}
+
+// roomName returns the name of roomID, from the hub if the room is live and
+// from disk otherwise.
+func (h *Hub) roomName(roomID string) string {
+	if room, exists := h.lookupRoom(roomID); exists {
+		room.mutex.RLock()
+		defer room.mutex.RUnlock()
+		return room.Name
+	}
+	return h.loadRoomName(roomID)
+}
+
+// handleRename renames the room and tells everyone, the sender included.
+func handleRename(room *Room, sender *Client, msg *Message) error {
+	name, err := cleanRoomName(msg.Name)
+	if err != nil {
+		return err
+	}
+	if err := room.hub.saveRoomName(room.ID, name); err != nil {
+		sender.logger.Error("Failed to save room name", "error", err)
+		return errors.New("failed to rename the room")
+	}
+	room.mutex.Lock()
+	room.Name = name
+	room.mutex.Unlock()
+
+	broadcast(room, Message{
+		Type:     MessageRoomRenamed,
+		RoomID:   room.ID,
+		RoomName: name,
+	})
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage keeps files as objects in an S3 bucket, or in any service
+// speaking the S3 API (MinIO, R2, ...) when an endpoint is configured.
+// Requests are signed with AWS Signature Version 4 directly rather than
+// through the AWS SDK, which would be by far the largest dependency of the
+// server for the handful of calls it needs.
+
+const (
+	// s3RequestTimeout bounds how long S3 may take to start answering.
+	s3RequestTimeout = 30 * time.Second
+	// s3SkipLimit is how far forward an s3Object reads and discards to
+	// satisfy a seek before it makes a new request instead.
+	s3SkipLimit = 64 << 10
+	// s3UnsignedPayload is sent in place of a body hash, so that uploads can
+	// be streamed. Requests still go over TLS unless an http endpoint is
+	// configured.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config selects the bucket used when STORAGE is "s3". Credentials come
+// from the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN variables.
+type S3Config struct {
+	Bucket string // S3_BUCKET
+	Region string // S3_REGION
+	// Endpoint is the base URL of an S3-compatible service, from
+	// S3_ENDPOINT. Set, it is addressed path-style (<endpoint>/<bucket>);
+	// empty uses AWS itself.
+	Endpoint string
+	// Prefix is prepended to every object key, from S3_PREFIX, so the
+	// bucket can be shared.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type s3Storage struct {
+	cfg    S3Config
+	base   *url.URL // bucket URL, with a trailing slash
+	client *http.Client
+}
+
+func newS3Storage(cfg S3Config) (*s3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3_BUCKET is required")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+
+	raw := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", cfg.Bucket, cfg.Region)
+	if cfg.Endpoint != "" {
+		raw = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + cfg.Bucket + "/"
+	}
+	base, err := url.Parse(raw)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3RequestTimeout
+	return &s3Storage{cfg: cfg, base: base, client: &http.Client{Transport: transport}}, nil
+}
+
+func (s *s3Storage) objectURL(name string) *url.URL {
+	u := *s.base
+	u.Path += s.cfg.Prefix + name
+	return &u
+}
+
+// do signs and sends a request. A 404 becomes an error matching
+// fs.ErrNotExist and any other status outside 2xx an error carrying S3's
+// error code.
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3 %s %s: %w", req.Method, req.URL.Path, fs.ErrNotExist)
+	}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	return nil, fmt.Errorf("s3 %s %s: status %d %s %s", req.Method, req.URL.Path, resp.StatusCode, body.Code, body.Message)
+}
+
+// Save uploads r with a single PUT, which needs the size up front. Files
+// from uploads are seekable; anything else is spooled to a temporary file
+// first.
+func (s *s3Storage) Save(name string, r io.Reader) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		tmp, err := os.CreateTemp("", "audio-sync-s3-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		rs = tmp
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(name).String(), io.NopCloser(rs))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType, ok := audioContentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, StoredFile, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, StoredFile{}, err
+	}
+	return &s3Object{s: s, name: name, size: info.Size}, info, nil
+}
+
+func (s *s3Storage) Stat(name string) (StoredFile, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(name).String(), nil)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StoredFile{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(name).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) List(prefix string) ([]StoredFile, error) {
+	var files []StoredFile
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := *s.base
+		u.RawQuery = s3EncodeQuery(query)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			files = append(files, StoredFile{
+				Name:    strings.TrimPrefix(obj.Key, s.cfg.Prefix),
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// sign adds AWS Signature Version 4 headers to req. Only the host and the
+// x-amz-* headers are signed, so callers may set others afterwards.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.cfg.SessionToken)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, headers.String(), signedHeaders, s3UnsignedPayload,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.cfg.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EncodeQuery encodes query sorted by key with spaces as %20, which is the
+// canonical form Signature Version 4 expects.
+func s3EncodeQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// s3Object reads an object with ranged GETs. A request is only made on the
+// first Read after a seek, so http.ServeContent seeking to the end to learn
+// the size costs nothing.
+type s3Object struct {
+	s      *s3Storage
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := http.NewRequest(http.MethodGet, o.s.objectURL(o.name).String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.s.do(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF {
+		if o.offset < o.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		// Hold the EOF back for the next Read, like a file would: the wav
+		// decoder mistakes data returned along with it for a sample count.
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset == o.offset {
+		return offset, nil
+	}
+
+	if o.body != nil && offset > o.offset && offset-o.offset <= s3SkipLimit {
+		if _, err := io.CopyN(io.Discard, o, offset-o.offset); err == nil {
+			return offset, nil
+		}
+	}
+	o.Close()
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Skip buttons send a seek_relative with a signed Delta in seconds rather
+// than a position of their own. The server moves the room's live position
+// by it, clamped to the start of the track and, if its duration is known,
+// to the end, and sends everyone, the sender included, the seek it came to.
+// Pressing skip near either end of a track therefore lands everyone on the
+// same position, however far their players had drifted.
+
+var errZeroDelta = errors.New("seek_relative needs a non-zero delta")
+
+func validateSeekRelative(msg *Message) error {
+	if msg.Delta == 0 {
+		return errZeroDelta
+	}
+	return nil
+}
+
+// handleSeekRelative applies a seek_relative and broadcasts the seek it
+// resolved to, throttled like any other seek.
+func handleSeekRelative(room *Room, sender *Client, msg *Message) error {
+	seek, err := seekRelative(room, msg)
+	if err != nil {
+		return err
+	}
+	persistRoom(room)
+	if !throttleSeek(room, nil, &seek) {
+		return nil
+	}
+	broadcast(room, seek)
+	return nil
+}
+
+// seekRelative moves the room's position by msg.Delta and returns the seek
+// to tell clients about.
+func seekRelative(room *Room, msg *Message) (Message, error) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	if err := checkSeq(room, msg); err != nil {
+		return Message{}, err
+	}
+
+	position := max(currentPosition(room)+msg.Delta, 0)
+	if room.CurrentTrack < len(room.Playlist) {
+		if duration := room.Playlist[room.CurrentTrack].Duration; duration > 0 {
+			position = min(position, duration)
+		}
+	}
+
+	room.Seeking = false
+	room.CurrentTime = position
+	room.LastUpdate = time.Now()
+	return Message{
+		Type:       MessageSeek,
+		RoomID:     room.ID,
+		Time:       &position,
+		IsPlaying:  room.IsPlaying,
+		Track:      room.CurrentTrack,
+		Seq:        bumpSeq(room),
+		ServerTime: serverNow(),
+	}, nil
+}
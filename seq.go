@@ -0,0 +1,46 @@
+package main
+
+import "errors"
+
+// Every change to a room's playback state bumps the room's Seq, and every
+// message carrying that state is stamped with it: the change itself,
+// sync_state and sync_pulse. Clients remember the highest Seq they have
+// seen, skip updates stamped lower, and put it in the control messages they
+// send. A control message whose Seq is lower than the room's was decided on
+// a state that has since changed (the server ended the track, say, while
+// the host was seeking in it), so it is ignored and the sender is sent the
+// current state instead.
+//
+// The host counts its own changes ahead of the server's reply, so a message
+// with a Seq above the room's is accepted. Messages without a Seq, from
+// clients that predate it, are always accepted.
+
+// errStaleMessage is returned for a control message older than the room's
+// state.
+var errStaleMessage = errors.New("message is based on an outdated playback state")
+
+// checkSeq returns errStaleMessage if msg predates the room's current state.
+// The caller must hold room.mutex.
+func checkSeq(room *Room, msg *Message) error {
+	if msg.Seq != 0 && msg.Seq < room.Seq {
+		return errStaleMessage
+	}
+	return nil
+}
+
+// bumpSeq records a change to the room's playback state and returns the new
+// Seq. The caller must hold room.mutex.
+func bumpSeq(room *Room) uint64 {
+	room.Seq++
+	return room.Seq
+}
+
+// rejectControl tells sender why its control message was not applied. A
+// stale sender is also sent the current state, so that its next message is
+// not stale too.
+func rejectControl(room *Room, sender *Client, err error) {
+	sendError(sender, err.Error())
+	if errors.Is(err, errStaleMessage) {
+		sendSyncState(room, sender)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckSeq(t *testing.T) {
+	room := &Room{Seq: 5}
+	tests := []struct {
+		seq     uint64
+		wantErr error
+	}{
+		{0, nil}, // predates sequence numbers
+		{4, errStaleMessage},
+		{5, nil},
+		{6, nil}, // the host counting ahead
+	}
+	for _, tt := range tests {
+		if err := checkSeq(room, &Message{Type: MessagePlay, Seq: tt.seq}); !errors.Is(err, tt.wantErr) {
+			t.Errorf("checkSeq(seq %d) = %v, want %v", tt.seq, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReorderedControlMessagesAreDropped(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000b2"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	listener.expectCount(2)
+
+	// The host plays, then pauses, but a second play decided before the
+	// pause arrives after it.
+	host.send(Message{Type: MessagePlay, Time: at(1)})
+	play := listener.expect(MessagePlay)
+	host.send(Message{Type: MessagePause, Time: at(2), Seq: play.Seq})
+	pause := listener.expect(MessagePause)
+	if pause.Seq <= play.Seq {
+		t.Fatalf("pause seq %d is not after play seq %d", pause.Seq, play.Seq)
+	}
+	host.send(Message{Type: MessagePlay, Time: at(1.5), Seq: play.Seq})
+
+	if got := host.expect(MessageError); got.Error != errStaleMessage.Error() {
+		t.Errorf("error = %q, want %q", got.Error, errStaleMessage)
+	}
+	state := host.expect(MessageSyncState)
+	if state.IsPlaying || state.Seq != pause.Seq {
+		t.Errorf("sync_state after stale play = playing %v seq %d, want paused at seq %d", state.IsPlaying, state.Seq, pause.Seq)
+	}
+	listener.expectNone(MessagePlay, 300*time.Millisecond)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every client is given a session token on connect. When a connection drops
+// without a close frame, as it does when a phone loses signal, the client
+// keeps its place in the room for config.SessionGrace: it stays in the user
+// list and keeps the host role, and nobody is told it left. Reconnecting
+// with ?session=<token> within that window picks up the same identity on
+// the new connection, again without a join being announced. Once the window
+// passes the client is removed as if it had just left.
+//
+// Clients that close the connection themselves, or that the server
+// disconnects (kicked, idle, too slow, timed out writing, flooding, or the
+// room being deleted or the server shutting down) leave straight away.
+
+// defaultSessionGrace is how long a dropped client's place is kept unless
+// SESSION_GRACE says otherwise.
+const defaultSessionGrace = 30 * time.Second
+
+// sessionTokenBytes is the number of random bytes in a session token.
+const sessionTokenBytes = 16
+
+// detachedClient is a client whose connection dropped and whose place in the
+// room is being held for it.
+type detachedClient struct {
+	client *Client
+	timer  *time.Timer
+}
+
+// sendSession gives a client its session token. Like the host key, it is
+// only ever sent to its owner.
+func sendSession(client *Client) {
+	client.Send(Message{
+		Type:     MessageSession,
+		ClientID: client.ID,
+		Session:  client.session,
+	})
+}
+
+// canResume reports whether client's read loop, which ended with err, lost
+// the connection rather than being told to close it, closing it for an
+// oversized message or a flood of them, or being disconnected by the server.
+func canResume(client *Client, err error) bool {
+	if client.serverClosed.Load() {
+		return false
+	}
+	if errors.Is(err, websocket.ErrReadLimit) || errors.Is(err, errMessageFlood) {
+		return false
+	}
+	return !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// detachClient holds client's place in the room for config.SessionGrace
+// after its connection dropped, and reports whether it did. It declines for
+// deleted rooms and during shutdown, whose clients should leave at once.
+func (h *Hub) detachClient(room *Room, client *Client) bool {
+	if h.shuttingDown.Load() {
+		return false
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.Closed || !room.Clients[client] {
+		return false
+	}
+	room.detached[client.session] = &detachedClient{
+		client: client,
+		timer:  time.AfterFunc(h.config.SessionGrace, func() { h.expireSession(room, client) }),
+	}
+	return true
+}
+
+// expireSession removes a detached client whose grace period has run out,
+// telling the room like any other departure. It does nothing if the client
+// has resumed in the meantime.
+func (h *Hub) expireSession(room *Room, client *Client) {
+	h.mutex.Lock()
+	room.mutex.Lock()
+	if d, ok := room.detached[client.session]; !ok || d.client != client {
+		room.mutex.Unlock()
+		h.mutex.Unlock()
+		return
+	}
+	delete(room.detached, client.session)
+	wasHost, emptied := h.removeClientLocked(room, client)
+	room.mutex.Unlock()
+	h.mutex.Unlock()
+	if emptied {
+		h.deleteAbandonedAudio(room.ID)
+	}
+
+	client.logger.Info("Client session expired")
+	broadcastUserCount(room)
+	broadcastUserList(room)
+	if wasHost {
+		sendHostChanged(room)
+	}
+}
+
+// resumeSession moves the detached client holding token in roomID onto conn,
+// returning the room and the client for the new connection. It reports
+// false if there is no such session, for instance because it has expired.
+func (h *Hub) resumeSession(roomID, token string, conn *websocket.Conn, logger *slog.Logger) (*Room, *Client, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	room, exists := h.rooms[roomID]
+	if !exists {
+		return nil, nil, false
+	}
+
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	d, ok := room.detached[token]
+	if !ok {
+		return nil, nil, false
+	}
+	// If the timer has already fired, expireSession is waiting for the
+	// locks and will find the session gone.
+	d.timer.Stop()
+	delete(room.detached, token)
+
+	old := d.client
+	client := newClient(conn, logger, old.writeTimeout)
+	client.ID = old.ID
+	client.logger = logger.With("clientId", old.ID)
+	client.Name = old.Name
+	client.unfollowed = old.unfollowed
+	client.hostKey = old.hostKey
+	client.session = old.session
+	client.joinedAt = old.joinedAt
+
+	delete(room.Clients, old)
+	room.Clients[client] = true
+	if room.Host == old {
+		room.Host = client
+	}
+	room.LastActive = time.Now()
+	return room, client, true
+}
+
+// expireDetached ends client's grace period now if it is detached, so that
+// it is removed without waiting. The caller must hold room.mutex.
+func expireDetached(room *Room, client *Client) {
+	if d, ok := room.detached[client.session]; ok && d.client == client {
+		d.timer.Reset(0)
+	}
+}
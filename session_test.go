@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCanResume(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		serverClosed bool
+		want         bool
+	}{
+		{"dropped connection", io.ErrUnexpectedEOF, false, true},
+		{"abnormal closure", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, false, true},
+		{"normal closure", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false, false},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, false, false},
+		{"oversized message", websocket.ErrReadLimit, false, false},
+		{"flood", errMessageFlood, false, false},
+		{"closed by server", errors.New("use of closed network connection"), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{}
+			client.serverClosed.Store(tt.serverClosed)
+			if got := canResume(client, tt.err); got != tt.want {
+				t.Errorf("canResume(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDroppedClientResumesSession(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000b7"
+
+	host := dialRoom(t, srv, roomID)
+	session := host.expect(MessageSession)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	listener.expectCount(2)
+
+	// Drop the connection without a close frame, as a lost signal would.
+	host.conn.UnderlyingConn().Close()
+	listener.expectNone(MessageUserCount, 300*time.Millisecond)
+
+	resumed := dialRoom(t, srv, roomID+"?session="+session.Session)
+	if !resumed.expect(MessageHostChanged).IsHost {
+		t.Error("resumed host lost the host role")
+	}
+	if got := resumed.expect(MessageSession); got.ClientID != session.ClientID {
+		t.Errorf("resumed as client %q, want %q", got.ClientID, session.ClientID)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "maps"
+
+// Each room keeps a few counters over its lifetime, for summing up a
+// session after the fact: the most clients it has held at once, how many
+// joins it has seen and how many messages its clients have sent, of each
+// type. They are guarded by room.mutex, served with the rest of the room's
+// details from /api/room/:id and saved with its state, so they survive a
+// restart.
+//
+// A client resuming its session is not a new join, and one that was held
+// detached still counted towards the peak while it was.
+
+// unknownMessageType is what messages of a type no handler takes are
+// counted as, so that a client cannot grow MessagesByType without bound.
+const unknownMessageType = "unknown"
+
+// RoomStats are a room's lifetime counters.
+type RoomStats struct {
+	PeakUsers      int              `json:"peakUsers"`
+	TotalJoins     int64            `json:"totalJoins"`
+	TotalMessages  int64            `json:"totalMessages"`
+	MessagesByType map[string]int64 `json:"messagesByType,omitempty"`
+}
+
+// snapshot copies the stats, so that they can be read once room.mutex is
+// released. The caller must hold room.mutex, for reading at least.
+func (s RoomStats) snapshot() RoomStats {
+	s.MessagesByType = maps.Clone(s.MessagesByType)
+	return s
+}
+
+// countJoin records a client joining the room. The caller must hold
+// room.mutex, with the client already in room.Clients.
+func countJoin(room *Room) {
+	room.Stats.TotalJoins++
+	room.Stats.PeakUsers = max(room.Stats.PeakUsers, len(room.Clients))
+}
+
+// countMessage records a message of msgType from one of the room's
+// clients. The caller must hold room.mutex.
+func countMessage(room *Room, msgType string) {
+	if _, ok := messageHandlers[msgType]; !ok {
+		msgType = unknownMessageType
+	}
+	if room.Stats.MessagesByType == nil {
+		room.Stats.MessagesByType = make(map[string]int64)
+	}
+	room.Stats.TotalMessages++
+	room.Stats.MessagesByType[msgType]++
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StoredFile describes one file in a Storage.
+type StoredFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage holds the files a room's playlist is made of: uploaded tracks,
+// their transcoded copies and remote track URLs, all named as in
+// trackFilename, and the rooms' join tokens and passwords. The small
+// sidecars kept beside them (metadata, peaks) always stay in the local
+// uploads directory. Open and Stat return an error matching fs.ErrNotExist
+// for a name that is not stored.
+type Storage interface {
+	Save(name string, r io.Reader) error
+	Open(name string) (io.ReadSeekCloser, StoredFile, error)
+	Stat(name string) (StoredFile, error)
+	Delete(name string) error
+	// List returns the files whose names start with prefix.
+	List(prefix string) ([]StoredFile, error)
+}
+
+// localStorage keeps files in a directory, which it shares with the
+// sidecars, so List returns those too.
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) *localStorage {
+	return &localStorage{dir: dir}
+}
+
+// Save writes r through a temporary file and a rename, so a reader never
+// sees a half-written file.
+func (s *localStorage) Save(name string, r io.Reader) error {
+	tmp, err := os.CreateTemp(s.dir, ".save-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) Open(name string) (io.ReadSeekCloser, StoredFile, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, StoredFile{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, StoredFile{}, err
+	}
+	return f, storedFile(info), nil
+}
+
+func (s *localStorage) Stat(name string) (StoredFile, error) {
+	info, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return storedFile(info), nil
+}
+
+func (s *localStorage) Delete(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// List skips directories and dot files, such as the chunked upload
+// directory and Save's temporary files.
+func (s *localStorage) List(prefix string) ([]StoredFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []StoredFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, storedFile(info))
+	}
+	return files, nil
+}
+
+func storedFile(info os.FileInfo) StoredFile {
+	return StoredFile{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// readStored returns the contents of name in s.
+func readStored(s Storage, name string) ([]byte, error) {
+	f, _, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// saveHashed saves src to storage as name and returns the hex SHA-256 of
+// what was saved, hashed on the way through rather than in a second pass.
+func (h *Hub) saveHashed(name string, src io.ReadSeeker) (string, error) {
+	r := &hashingReader{src: src, hash: sha256.New()}
+	if err := h.storage.Save(name, r); err != nil {
+		return "", err
+	}
+	if r.skipped {
+		// Only seeking back to the start is expected; anywhere else and
+		// the hash would not cover the file.
+		return "", errors.New("storage seeked within the file while saving it")
+	}
+	return hex.EncodeToString(r.hash.Sum(nil)), nil
+}
+
+// hashingReader hashes everything read through it. It stays seekable so
+// that a Storage may measure the source before reading it, as S3 does:
+// seeking back to the start starts the hash over.
+type hashingReader struct {
+	src     io.ReadSeeker
+	hash    hash.Hash
+	skipped bool
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.src.Seek(offset, whence)
+	if err == nil && pos == 0 {
+		r.hash.Reset()
+		r.skipped = false
+	} else if whence != io.SeekEnd || offset != 0 {
+		r.skipped = true
+	}
+	return pos, err
+}
+
+// The uploads directory is created at startup, but it can disappear or turn
+// read-only while the server runs (a cleaned-up tmpfs, a remounted volume).
+// Everything that writes into it checks it first, recreating it if it is
+// missing, so such failures surface as a clear 503 rather than whichever
+// write happens to fail first.
+
+// ensureUploadDir makes sure the uploads directory exists and that files can
+// be created in it.
+func (h *Hub) ensureUploadDir() error {
+	if err := os.MkdirAll(h.config.UploadDir, 0755); err != nil {
+		return err
+	}
+	return h.checkUploadDirWritable()
+}
+
+// checkUploadDirWritable creates and removes a probe file in the uploads
+// directory.
+func (h *Hub) checkUploadDirWritable() error {
+	f, err := os.CreateTemp(h.config.UploadDir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// requireUploadDir responds 503 and returns false if the uploads directory
+// cannot be written to.
+func (s *Server) requireUploadDir(c *gin.Context) bool {
+	if err := s.hub.ensureUploadDir(); err != nil {
+		slog.Error("Uploads directory is not writable", "path", s.config.UploadDir, "error", err)
+		respondError(c, http.StatusServiceUnavailable, "Upload storage is unavailable, try again later")
+		return false
+	}
+	return true
+}
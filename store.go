@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RoomState is the part of a room worth keeping across restarts. Clients
+// and the host are tied to live connections and are not persisted.
+type RoomState struct {
+	ID           string  `json:"id"`
+	Playlist     []Track `json:"playlist"`
+	CurrentTrack int     `json:"currentTrack"`
+	// CurrentTime is the position when the state was saved, at LastUpdate,
+	// so a playing room resumes from there rather than from wherever the
+	// time spent down would have taken it.
+	CurrentTime float64   `json:"currentTime"`
+	IsPlaying   bool      `json:"isPlaying"`
+	LastUpdate  time.Time `json:"lastUpdate"`
+	// Volume is nil in rooms saved before volumes existed.
+	Volume *float64 `json:"volume,omitempty"`
+	Muted  bool     `json:"muted,omitempty"`
+	// CreatedAt is zero in rooms saved before it was recorded.
+	CreatedAt  time.Time `json:"createdAt"`
+	LastActive time.Time `json:"lastActive"`
+	// Stats are zero in rooms saved before they were kept.
+	Stats RoomStats `json:"stats"`
+}
+
+// RoomStore persists room state. Save is called whenever a room's state
+// changes and Delete once the room is gone, both with the hub or room locks
+// held, so neither may wait on I/O. LoadAll restores the rooms at startup
+// and Flush writes out whatever is still pending at shutdown.
+type RoomStore interface {
+	Save(state RoomState) error
+	Delete(roomID string) error
+	LoadAll() ([]RoomState, error)
+	Flush() error
+}
+
+type memoryRoomStore struct {
+	rooms map[string]RoomState
+	mutex sync.Mutex
+}
+
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{rooms: make(map[string]RoomState)}
+}
+
+func (s *memoryRoomStore) Save(state RoomState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rooms[state.ID] = state
+	return nil
+}
+
+func (s *memoryRoomStore) Delete(roomID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.rooms, roomID)
+	return nil
+}
+
+func (s *memoryRoomStore) LoadAll() ([]RoomState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states := make([]RoomState, 0, len(s.rooms))
+	for _, state := range s.rooms {
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (s *memoryRoomStore) Flush() error {
+	return nil
+}
+
+// roomStoreFlushDelay is how long fileRoomStore lets changes gather before
+// writing them out.
+const roomStoreFlushDelay = time.Second
+
+// fileRoomStore keeps every room in one JSON file. Changes are made in
+// memory and marked dirty; the file is rewritten at most once per
+// roomStoreFlushDelay from a timer, never by Save or Delete themselves.
+// Each write goes through a temporary file and a rename, so a crash
+// mid-write leaves the previous version intact.
+type fileRoomStore struct {
+	path string
+	mem  *memoryRoomStore
+
+	// mutex guards dirty and timer; writeMu serialises writes to path.
+	mutex   sync.Mutex
+	dirty   bool
+	timer   *time.Timer
+	writeMu sync.Mutex
+}
+
+// newFileRoomStore opens the store at path, loading any rooms already in it.
+func newFileRoomStore(path string) (*fileRoomStore, error) {
+	s := &fileRoomStore{path: path, mem: newMemoryRoomStore()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var states []RoomState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		s.mem.rooms[state.ID] = state
+	}
+	return s, nil
+}
+
+func (s *fileRoomStore) Save(state RoomState) error {
+	s.mem.Save(state)
+	s.markDirty()
+	return nil
+}
+
+func (s *fileRoomStore) Delete(roomID string) error {
+	s.mem.Delete(roomID)
+	s.markDirty()
+	return nil
+}
+
+func (s *fileRoomStore) LoadAll() ([]RoomState, error) {
+	return s.mem.LoadAll()
+}
+
+// markDirty schedules a flush unless one is already pending.
+func (s *fileRoomStore) markDirty() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dirty = true
+	if s.timer == nil {
+		s.timer = time.AfterFunc(roomStoreFlushDelay, func() {
+			if err := s.Flush(); err != nil {
+				slog.Error("Failed to write room store", "path", s.path, "error", err)
+			}
+		})
+	}
+}
+
+// Flush writes all rooms to disk if anything changed since the last write.
+// A failed write leaves the store dirty, to be retried with the next change.
+func (s *fileRoomStore) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mutex.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	dirty := s.dirty
+	s.dirty = false
+	s.mutex.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	if err := s.write(); err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// write replaces the file with the rooms currently in memory.
+func (s *fileRoomStore) write() error {
+	states, _ := s.mem.LoadAll()
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".rooms-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// roomState snapshots the persistent part of room, with the time played
+// since LastUpdate folded into CurrentTime. The caller must hold room.mutex.
+func roomState(room *Room) RoomState {
+	volume := room.Volume
+	return RoomState{
+		ID:           room.ID,
+		Playlist:     append([]Track(nil), room.Playlist...),
+		CurrentTrack: room.CurrentTrack,
+		CurrentTime:  currentPosition(room),
+		IsPlaying:    room.IsPlaying,
+		LastUpdate:   time.Now(),
+		Volume:       &volume,
+		Muted:        room.Muted,
+		CreatedAt:    room.CreatedAt,
+		LastActive:   room.LastActive,
+		Stats:        room.Stats.snapshot(),
+	}
+}
+
+// restoredCreatedAt is when a restored room was created. For rooms saved
+// before that was recorded, their last activity is the best guess there is.
+func restoredCreatedAt(state RoomState) time.Time {
+	if state.CreatedAt.IsZero() {
+		return state.LastActive
+	}
+	return state.CreatedAt
+}
+
+// persistRoom saves the room's current state to the hub's store.
+func persistRoom(room *Room) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	saveRoomState(room)
+}
+
+// saveRoomState is persistRoom for callers already holding room.mutex.
+func saveRoomState(room *Room) {
+	if room.Closed {
+		return
+	}
+	if err := room.hub.store.Save(roomState(room)); err != nil {
+		slog.Error("Failed to persist room", "roomId", room.ID, "error", err)
+	}
+}
+
+// restoreRooms registers every stored room in the hub, without clients, so
+// that reconnecting clients pick up where they left off. A room that was
+// playing carries on from the position it was saved at. Rooms nobody
+// returns to are expired by the janitor like any other idle room.
+//
+// A stored room whose ID would not be accepted for a new room is skipped,
+// and no more than config.MaxRooms rooms are restored, keeping the most
+// recently active.
+func (h *Hub) restoreRooms() error {
+	states, err := h.store.LoadAll()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].LastActive.After(states[j].LastActive)
+	})
+
+	// The sidecars are read before h.mutex is taken, as in createRoom.
+	rooms := make([]*Room, 0, min(len(states), h.config.MaxRooms))
+	for _, state := range states {
+		if !validateRoomID(state.ID) {
+			slog.Warn("Skipped stored room with an invalid ID", "roomId", state.ID)
+			continue
+		}
+		if len(rooms) == h.config.MaxRooms {
+			slog.Warn("Skipped stored rooms over the room limit", "limit", h.config.MaxRooms)
+			break
+		}
+		rooms = append(rooms, &Room{
+			hub:          h,
+			ID:           state.ID,
+			Clients:      make(map[*Client]bool),
+			detached:     make(map[string]*detachedClient),
+			TokenHash:    h.loadTokenHash(state.ID),
+			PasswordHash: h.loadPasswordHash(state.ID),
+			Name:         h.loadRoomName(state.ID),
+			CurrentTime:  state.CurrentTime,
+			IsPlaying:    state.IsPlaying,
+			LastUpdate:   now,
+			Playlist:     state.Playlist,
+			CurrentTrack: state.CurrentTrack,
+			Volume:       restoredVolume(state),
+			Muted:        state.Muted,
+			CreatedAt:    restoredCreatedAt(state),
+			LastActive:   state.LastActive,
+			Stats:        state.Stats,
+		})
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, room := range rooms {
+		h.rooms[room.ID] = room
+	}
+	return nil
+}
+
+// flushRooms saves every live room and writes the store out, for shutdown:
+// the saves that clients leave behind as they disconnect may not be made,
+// let alone flushed, before the process exits.
+func (h *Hub) flushRooms() error {
+	for _, room := range h.snapshot() {
+		persistRoom(room)
+	}
+	return h.store.Flush()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRoomStoreWritesOnFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.json")
+	store, err := newFileRoomStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(RoomState{ID: "00000000000000b5", CurrentTrack: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// The write is debounced well past the save.
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("store file written straight after Save: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newFileRoomStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, _ := reopened.LoadAll()
+	if len(states) != 1 || states[0].ID != "00000000000000b5" || states[0].CurrentTrack != 2 {
+		t.Errorf("reopened store has %+v, want the saved room", states)
+	}
+
+	if err := store.Delete("00000000000000b5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ = newFileRoomStore(path)
+	if states, _ := reopened.LoadAll(); len(states) != 0 {
+		t.Errorf("reopened store has %+v after Delete, want none", states)
+	}
+}
+
+func TestRestoredRoomResumesWhereItWasSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.json")
+	store, err := newFileRoomStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHub(t)
+	h.store = store
+
+	// A room that has been playing for 30s since it was last touched at 10s.
+	room := h.loadRoom("00000000000000b6")
+	room.IsPlaying = true
+	room.CurrentTime = 10
+	room.LastUpdate = time.Now().Add(-30 * time.Second)
+	h.rooms[room.ID] = room
+	if err := h.flushRooms(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is down for a minute, which must not count as playback.
+	reopened, err := newFileRoomStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, _ := reopened.LoadAll()
+	if len(states) != 1 {
+		t.Fatalf("store has %d rooms, want 1", len(states))
+	}
+	states[0].LastUpdate = states[0].LastUpdate.Add(-time.Minute)
+	reopened.Save(states[0])
+	t.Cleanup(func() { reopened.Flush() })
+
+	restored := newTestHub(t)
+	restored.store = reopened
+	if err := restored.restoreRooms(); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := restored.lookupRoom("00000000000000b6")
+	if !ok {
+		t.Fatal("room was not restored")
+	}
+	got.mutex.RLock()
+	defer got.mutex.RUnlock()
+	if !got.IsPlaying {
+		t.Error("restored room is not playing")
+	}
+	if pos := currentPosition(got); math.Abs(pos-40) > 1 {
+		t.Errorf("restored position = %.2fs, want about 40s", pos)
+	}
+}
+
+func TestRestoreRoomsSkipsInvalidIDsAndStopsAtRoomLimit(t *testing.T) {
+	h := newTestHub(t)
+	h.config.MaxRooms = 2
+	now := time.Now()
+	for id, idle := range map[string]time.Duration{
+		"../../etc":        0,
+		"00000000000000c1": 3 * time.Hour,
+		"00000000000000c2": time.Hour,
+		"00000000000000c3": 2 * time.Hour,
+	} {
+		h.store.Save(RoomState{ID: id, LastActive: now.Add(-idle)})
+	}
+
+	if err := h.restoreRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.snapshot()); n != h.config.MaxRooms {
+		t.Fatalf("restored %d rooms, want %d", n, h.config.MaxRooms)
+	}
+	for _, id := range []string{"00000000000000c2", "00000000000000c3"} {
+		if _, ok := h.lookupRoom(id); !ok {
+			t.Errorf("room %s was not restored", id)
+		}
+	}
+}
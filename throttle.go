@@ -0,0 +1,79 @@
+package main
+
+import "time"
+
+// Seeks come in bursts: a client sending one per seeking event while the
+// scrubber is dragged would have the room jump about dozens of times a
+// second. The room's state always takes the latest seek at once, but at
+// most one seek per config.SeekThrottle is relayed. A seek arriving inside
+// the window is held, replacing any seek already held, and relayed when the
+// window ends. Every other control message carries the position itself, so
+// it is relayed as usual and discards the held seek it supersedes.
+
+// defaultSeekThrottle is the seek relay window unless SEEK_THROTTLE says
+// otherwise.
+const defaultSeekThrottle = 100 * time.Millisecond
+
+// seekThrottle is a room's seek relay state, guarded by the room's mutex.
+type seekThrottle struct {
+	last    time.Time // when a seek was last relayed
+	pending *heldSeek
+	timer   *time.Timer
+}
+
+type heldSeek struct {
+	sender *Client
+	msg    Message
+}
+
+// throttleSeek reports whether msg, a seek already applied to the room, may
+// be relayed now. Otherwise it is held and relayed once the window ends.
+func throttleSeek(room *Room, sender *Client, msg *Message) bool {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+
+	t := &room.seekThrottle
+	now := time.Now()
+	if t.timer == nil && now.Sub(t.last) >= room.hub.config.SeekThrottle {
+		t.last = now
+		return true
+	}
+
+	if t.pending != nil {
+		seeksCollapsed.Inc()
+	}
+	t.pending = &heldSeek{sender: sender, msg: *msg}
+	if t.timer == nil {
+		t.timer = time.AfterFunc(room.hub.config.SeekThrottle-now.Sub(t.last), func() { flushSeek(room) })
+	}
+	return false
+}
+
+// flushSeek relays the held seek, if a later control message has not
+// discarded it.
+func flushSeek(room *Room) {
+	room.mutex.Lock()
+	t := &room.seekThrottle
+	held := t.pending
+	t.pending = nil
+	t.timer = nil
+	if held != nil {
+		t.last = time.Now()
+	}
+	room.mutex.Unlock()
+
+	if held == nil {
+		return
+	}
+	messagesRelayed.WithLabelValues(held.msg.Type).Inc()
+	room.Broadcast(held.msg, held.sender)
+}
+
+// dropHeldSeek discards the held seek, if any, for a control message that
+// supersedes it. The caller must hold room.mutex.
+func dropHeldSeek(room *Room) {
+	if room.seekThrottle.pending != nil {
+		room.seekThrottle.pending = nil
+		seeksCollapsed.Inc()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rooms may be created private, in which case they get a join token that
+// must be passed as ?token= to open the room's WebSocket, fetch its audio or
+// upload more tracks to it. Only a SHA-256 hash of the token is kept, as
+// <roomID>.token.json in the same Storage as the room's audio, so it is
+// deleted and expired along with the room and lives wherever the tracks do.
+// Rooms without a token file are open to anyone.
+//
+// The host of a live private room can rotate its token, should it leak:
+// the old token stops working at once for new connections and requests,
+// while clients already connected stay.
+
+// joinTokenBytes is the number of random bytes in a join token.
+const joinTokenBytes = 16
+
+type roomToken struct {
+	Hash string `json:"hash"` // hex-encoded SHA-256 of the token
+}
+
+func tokenName(roomID string) string {
+	return roomID + ".token.json"
+}
+
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// createJoinToken makes roomID private and returns its new join token.
+func (h *Hub) createJoinToken(roomID string) (string, error) {
+	token := generateHexID(joinTokenBytes)
+	data, err := json.Marshal(roomToken{Hash: hex.EncodeToString(hashToken(token))})
+	if err != nil {
+		return "", err
+	}
+	if err := h.storage.Save(tokenName(roomID), bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// loadTokenHash returns the stored token hash for roomID, or nil if the room
+// is open.
+func (h *Hub) loadTokenHash(roomID string) []byte {
+	data, err := readStored(h.storage, tokenName(roomID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		// Fail closed: storage that cannot be read must not open the room.
+		slog.Error("Failed to read join token", "roomId", roomID, "error", err)
+		return []byte{}
+	}
+	var stored roomToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		// Fail closed: a token file nobody can match keeps the room shut.
+		return []byte{}
+	}
+	hash, err := hex.DecodeString(stored.Hash)
+	if err != nil {
+		return []byte{}
+	}
+	return hash
+}
+
+// roomTokenHash returns the token hash of roomID, from the hub if the room is
+// live and from storage otherwise.
+func (h *Hub) roomTokenHash(roomID string) []byte {
+	if room, exists := h.lookupRoom(roomID); exists {
+		room.mutex.RLock()
+		defer room.mutex.RUnlock()
+		return room.TokenHash
+	}
+	return h.loadTokenHash(roomID)
+}
+
+// validJoinToken reports whether token grants access to roomID: the room's
+// join token or, for a room with a password, an auth token.
+func (h *Hub) validJoinToken(roomID, token string) bool {
+	want := h.roomTokenHash(roomID)
+	passwordHash := h.roomPasswordHash(roomID)
+	if want == nil && passwordHash == nil {
+		return true
+	}
+	if want != nil && subtle.ConstantTimeCompare(hashToken(token), want) == 1 {
+		return true
+	}
+	return passwordHash != nil && validAuthToken(roomID, token, passwordHash, time.Now())
+}
+
+// requireJoinToken responds 401 and returns false unless the request carries
+// a valid token for roomID.
+func (s *Server) requireJoinToken(c *gin.Context, roomID string) bool {
+	if s.hub.validJoinToken(roomID, c.Query("token")) {
+		return true
+	}
+	respondError(c, http.StatusUnauthorized, "Invalid or missing join token")
+	return false
+}
+
+// handleRotateToken gives a live private room a new join token, returned
+// in the response and nowhere else, replacing the old one. Only the current
+// host may do this, authenticating as for handleDeleteRoom.
+func (s *Server) handleRotateToken(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	room, exists := s.hub.lookupRoom(roomID)
+	if !exists {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+
+	if !requireHostKey(c, room) {
+		return
+	}
+
+	// The token is replaced under playlistMu, which deleteRoom holds while
+	// it deletes the room's files, so a deleted room cannot have its token
+	// written back. Storage is not touched under room.mutex.
+	s.hub.playlistMu.Lock()
+	defer s.hub.playlistMu.Unlock()
+	room.mutex.Lock()
+	closed, private := room.Closed, room.TokenHash != nil
+	room.mutex.Unlock()
+	if closed {
+		respondError(c, http.StatusNotFound, "Room not found")
+		return
+	}
+	if !private {
+		respondError(c, http.StatusBadRequest, "Room has no join token to rotate")
+		return
+	}
+	token, err := s.hub.createJoinToken(roomID)
+	if err != nil {
+		slog.Error("Failed to rotate join token", "roomId", roomID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to create join token")
+		return
+	}
+	room.mutex.Lock()
+	room.TokenHash = hashToken(token)
+	room.mutex.Unlock()
+
+	slog.Info("Join token rotated", "roomId", roomID, "clientIp", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{
+		"roomId":    roomID,
+		"joinToken": token,
+		"message":   "Join token rotated",
+	})
+}
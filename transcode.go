@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// When TRANSCODE is on and ffmpeg is installed, uploads in formats some
+// browsers cannot play are converted to MP3 in the background and stored
+// beside the original as <track file>.web.mp3. handleAudio serves the MP3
+// once it exists, unless the client asks for the original (see
+// negotiate.go), and the original until then, or if conversion fails.
+//
+// ffmpeg reads the original from a pipe, so it works whichever Storage holds
+// it. That rules out formats whose index sits at the end of the file, but
+// the one common such format, M4A, is played as is anyway.
+
+const (
+	transcodedSuffix = ".web.mp3"
+	// transcodeTimeout bounds a single ffmpeg run.
+	transcodeTimeout = 10 * time.Minute
+	// maxConcurrentTranscodes bounds how many ffmpeg processes run at once.
+	maxConcurrentTranscodes = 2
+)
+
+// webFriendlyExts are the formats every mainstream browser plays as is.
+var webFriendlyExts = map[string]bool{
+	".mp3": true,
+	".m4a": true,
+}
+
+// setupTranscoding looks for ffmpeg if transcoding is enabled and logs the
+// outcome either way.
+func (h *Hub) setupTranscoding(enabled bool) {
+	if !enabled {
+		slog.Info("Transcoding disabled")
+		return
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		slog.Warn("Transcoding disabled, ffmpeg not found", "error", err)
+		return
+	}
+	h.ffmpegPath = path
+	slog.Info("Transcoding enabled", "ffmpeg", path)
+}
+
+func transcodedName(name string) string {
+	return name + transcodedSuffix
+}
+
+// audioVariants returns the stored versions of the track stored as name,
+// most widely playable first: the transcoded copy, if there is one, and the
+// original.
+func (h *Hub) audioVariants(name string) []string {
+	if webFriendlyExts[strings.ToLower(filepath.Ext(name))] {
+		return []string{name}
+	}
+	web := transcodedName(name)
+	if _, err := h.storage.Stat(web); err == nil {
+		return []string{web, name}
+	}
+	return []string{name}
+}
+
+// transcodeInBackground starts converting the track stored as name to MP3 if
+// transcoding is enabled and the format needs it.
+func (h *Hub) transcodeInBackground(name string) {
+	if h.ffmpegPath == "" || webFriendlyExts[strings.ToLower(filepath.Ext(name))] {
+		return
+	}
+	go func() {
+		h.transcodeSlots <- struct{}{}
+		defer func() { <-h.transcodeSlots }()
+		if err := h.transcode(name); err != nil {
+			slog.Error("Transcoding failed", "track", name, "error", err)
+		}
+	}()
+}
+
+// transcode converts the track stored as name to MP3. ffmpeg writes to a
+// temporary file that is saved once complete, so a half-written copy is
+// never served.
+func (h *Hub) transcode(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+
+	src, _, err := h.storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "audio-sync-transcode-*.mp3")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, h.ffmpegPath,
+		"-nostdin", "-loglevel", "error", "-y",
+		"-i", "pipe:0",
+		"-vn", "-codec:a", "libmp3lame", "-q:a", "2",
+		"-f", "mp3", tmp.Name(),
+	)
+	cmd.Stdin = src
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := h.storage.Save(transcodedName(name), tmp); err != nil {
+		return err
+	}
+	slog.Info("Transcoded track", "track", name, "duration", time.Since(start).String())
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// postUpload posts files to /upload as the audio field, with extra form
+// fields, and returns the response.
+func postUpload(t *testing.T, srv *httptest.Server, fields map[string]string, files map[string][]byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for filename, data := range files {
+		part, err := form.CreateFormFile("audio", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	form.Close()
+
+	resp, err := http.Post(srv.URL+"/audio-sync/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestOversizedUploadIsRejected(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	h.config.MaxUploadBytes = 4 << 10
+
+	resp := postUpload(t, srv, nil, map[string][]byte{
+		"big.mp3": bytes.Repeat([]byte{0xff}, 16<<10),
+	})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	entries, err := os.ReadDir(h.config.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("stray file in uploads: %s", entry.Name())
+	}
+}
+
+// testWAV returns a silent mono 16-bit WAV file lasting seconds.
+func testWAV(seconds int) []byte {
+	const rate = 8000
+	samples := make([]byte, rate*2*seconds)
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.WriteString("RIFF")
+	binary.Write(&b, le, uint32(36+len(samples)))
+	b.WriteString("WAVEfmt ")
+	for _, field := range []any{uint32(16), uint16(1), uint16(1), uint32(rate), uint32(rate * 2), uint16(2), uint16(16)} {
+		binary.Write(&b, le, field)
+	}
+	b.WriteString("data")
+	binary.Write(&b, le, uint32(len(samples)))
+	b.Write(samples)
+	return b.Bytes()
+}
+
+// uploadResponse is the part of an upload's response these tests use.
+type uploadResponse struct {
+	RoomID string  `json:"roomId"`
+	Tracks []Track `json:"tracks"`
+}
+
+func TestAppendUploadNeedsHostKeyAndShowsInRoomInfo(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+
+	resp := postUpload(t, srv, nil, map[string][]byte{"one.wav": testWAV(1)})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first upload: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var created uploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	host := dialRoom(t, srv, created.RoomID)
+	hostKey := host.expect(MessageHostChanged).HostKey
+	if hostKey == "" {
+		t.Fatal("host was not given a host key")
+	}
+
+	appendTrack := func(key string) int {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("roomId", created.RoomID)
+		part, _ := form.CreateFormFile("audio", "two.wav")
+		part.Write(testWAV(1))
+		form.Close()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/audio-sync/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for key, want := range map[string]int{
+		"":          http.StatusUnauthorized,
+		"not-a-key": http.StatusForbidden,
+		hostKey:     http.StatusOK,
+	} {
+		if status := appendTrack(key); status != want {
+			t.Errorf("append with key %q: status = %d, want %d", key, status, want)
+		}
+	}
+
+	room, _ := h.lookupRoom(created.RoomID)
+	room.mutex.RLock()
+	playlist := append([]Track(nil), room.Playlist...)
+	room.mutex.RUnlock()
+	if len(playlist) != 2 {
+		t.Fatalf("playlist has %d tracks, want 2", len(playlist))
+	}
+
+	// Room info describes the track the room is on, not the first one.
+	host.send(Message{Type: MessageSelectTrack, Track: 1})
+	host.expect(MessageSelectTrack)
+	var info RoomInfo
+	getJSON(t, srv, "/audio-sync/api/room/"+created.RoomID, &info)
+	if info.AudioFilename != playlist[1].Filename || info.Metadata == nil || info.Metadata.OriginalFilename != "two.wav" {
+		t.Errorf("room info on track 1 = %q %+v, want %q", info.AudioFilename, info.Metadata, playlist[1].Filename)
+	}
+}
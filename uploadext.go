@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A track is stored under an extension from allowedAudioTypes, never one
+// taken as is from the client. The uploaded filename's extension is
+// lowercased, stripped of the trailing spaces and dots some tools leave,
+// mapped from the common aliases below and then looked up. When the name
+// has no extension, or one the server does not accept, the extension comes
+// from the sniffed content instead, so "recording" or "song.mp3.download"
+// holding an MP3 is stored as .mp3. Either way the content must be audio
+// of that format, and the formats the server can decode must decode, to no
+// longer than config.MaxAudioDuration.
+//
+// All of this is checked on the uploaded bytes, before a room ID is taken
+// or anything is written to storage, so that a rejected upload leaves
+// nothing behind.
+
+// maxUploadFilenameBytes bounds the filename an upload may give, which is
+// kept as its original filename. It is the most that most filesystems allow.
+const maxUploadFilenameBytes = 255
+
+// maxExtensionLength bounds the extension looked at, dot included. Nothing
+// longer can be accepted, so it is not worth lowercasing or looking up.
+const maxExtensionLength = 8
+
+// extensionAliases maps other extensions in use for the accepted formats to
+// the one they are stored as.
+var extensionAliases = map[string]string{
+	".mpga": ".mp3",
+	".wave": ".wav",
+	".oga":  ".ogg",
+	".opus": ".ogg",
+}
+
+// sniffedExtensions maps each content type sniffAudioType reports for an
+// accepted format to the extension it is stored as.
+var sniffedExtensions = map[string]string{
+	"audio/mpeg":      ".mp3",
+	"audio/wave":      ".wav",
+	"application/ogg": ".ogg",
+	"audio/ogg":       ".ogg",
+	"audio/flac":      ".flac",
+	"audio/mp4":       ".m4a",
+	"video/mp4":       ".m4a",
+}
+
+// decodedFormats are the extensions of the formats probeAudio decodes. An
+// upload in one of them must decode to a duration to be accepted.
+var decodedFormats = map[string]bool{
+	".mp3": true,
+	".wav": true,
+}
+
+var (
+	// errNotAudio is returned for an upload whose content is not audio of
+	// an accepted format, or not of the format its filename claims.
+	errNotAudio = errors.New("file content is not a supported audio type")
+	// errUndecodable is returned for an upload that looks like a format
+	// the server decodes but does not decode.
+	errUndecodable = errors.New("file could not be decoded")
+	// errTooLong is returned for an upload whose probed duration is over
+	// config.MaxAudioDuration.
+	errTooLong = errors.New("audio is too long")
+)
+
+// audioExtension returns the normalised extension of filename and whether
+// it is one the server accepts.
+func audioExtension(filename string) (string, bool) {
+	ext := filepath.Ext(strings.TrimRight(filename, " ."))
+	if len(ext) > maxExtensionLength {
+		return "", false
+	}
+	ext = strings.ToLower(ext)
+	if alias, ok := extensionAliases[ext]; ok {
+		ext = alias
+	}
+	_, ok := allowedAudioTypes[ext]
+	return ext, ok
+}
+
+// uploadExtension reads the start of r, the content of an upload named
+// filename, and returns the extension to store it under. It returns
+// errNotAudio if the content does not bear that extension out.
+func uploadExtension(r io.Reader, filename string) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	contentType := sniffAudioType(head[:n])
+
+	if ext, ok := audioExtension(filename); ok {
+		if !isAllowedAudio(ext, contentType) {
+			return "", errNotAudio
+		}
+		return ext, nil
+	}
+	if ext, ok := sniffedExtensions[contentType]; ok {
+		return ext, nil
+	}
+	return "", errNotAudio
+}
+
+// checkUpload validates r, size bytes uploaded as filename, returning the
+// extension to store it under and its probed metadata, which labelAudio
+// completes once it has a name. The extension is returned with
+// errUndecodable and errTooLong too.
+func (h *Hub) checkUpload(r io.ReadSeeker, size int64, filename string) (string, AudioMetadata, error) {
+	ext, err := uploadExtension(r, filename)
+	if err != nil {
+		return "", AudioMetadata{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", AudioMetadata{}, err
+	}
+	md := probeAudio(r, size, ext)
+	if decodedFormats[ext] && md.Duration <= 0 {
+		return ext, AudioMetadata{}, errUndecodable
+	}
+	if md.Duration > h.config.MaxAudioDuration.Seconds() {
+		return ext, AudioMetadata{}, errTooLong
+	}
+	return ext, md, nil
+}
+
+// requireValidUpload is checkUpload for a handler: on failure it responds
+// and returns false.
+func (s *Server) requireValidUpload(c *gin.Context, r io.ReadSeeker, size int64, filename string) (string, AudioMetadata, bool) {
+	ext, md, err := s.hub.checkUpload(r, size, filename)
+	switch {
+	case errors.Is(err, errNotAudio):
+		respondError(c, http.StatusUnsupportedMediaType, "File content is not a supported audio type, accepted types are "+acceptedExtensions)
+		return "", AudioMetadata{}, false
+	case errors.Is(err, errUndecodable):
+		respondError(c, http.StatusUnsupportedMediaType, "File could not be decoded as "+strings.TrimPrefix(ext, ".")+" audio")
+		return "", AudioMetadata{}, false
+	case errors.Is(err, errTooLong):
+		respondError(c, http.StatusRequestEntityTooLarge, "Audio is too long, maximum duration is "+s.config.MaxAudioDuration.String())
+		return "", AudioMetadata{}, false
+	case err != nil:
+		respondError(c, http.StatusBadRequest, "Failed to read file")
+		return "", AudioMetadata{}, false
+	}
+	return ext, md, true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An upload is read, probed and copied into storage in full before it is
+// answered, so a burst of them can swamp the disk and hold a lot of
+// memory. At most config.MaxUploads are processed at once, counting
+// multipart uploads and the assembly of chunked ones. By default one more
+// is turned away straight away with a 503 and a Retry-After; with
+// UPLOAD_QUEUE_WAIT set it waits up to that long for a slot first, and is
+// turned away only if none frees up.
+//
+// The per-IP rate limit in ratelimit.go still applies on top, and is
+// checked first.
+
+// defaultMaxUploads is how many uploads are processed at once unless
+// MAX_CONCURRENT_UPLOADS says otherwise.
+const defaultMaxUploads = 10
+
+// uploadBusyRetryAfter is the Retry-After given to an upload turned away
+// for want of a slot. Uploads finish within seconds, so it is short.
+const uploadBusyRetryAfter = 5 * time.Second
+
+// uploadGate returns middleware letting at most slots requests through at
+// once, each waiting up to wait for its turn.
+func uploadGate(slots int, wait time.Duration) gin.HandlerFunc {
+	inProgress := make(chan struct{}, slots)
+	return func(c *gin.Context) {
+		if !acquireSlot(c.Request.Context(), inProgress, wait) {
+			slog.Warn("Rejected upload, too many in progress", "limit", slots, "clientIp", c.ClientIP())
+			uploadsBusy.Inc()
+			c.Header("Retry-After", strconv.Itoa(int(uploadBusyRetryAfter.Seconds())))
+			abortError(c, http.StatusServiceUnavailable, "Too many uploads in progress, try again later")
+			return
+		}
+		defer func() { <-inProgress }()
+		c.Next()
+	}
+}
+
+// acquireSlot takes a slot in slots, waiting up to wait for one if none is
+// free, and reports whether it got one.
+func acquireSlot(ctx context.Context, slots chan struct{}, wait time.Duration) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Clients may pick a nickname by sending {"type": "join", "name": "..."}.
+// Whenever someone joins, leaves or renames, the room is sent a user_list
+// with everyone present; user_count is still sent alongside it for older
+// clients.
+
+// maxNameLength is the longest nickname accepted, in characters.
+const maxNameLength = 32
+
+// UserInfo describes one client in a user_list message. Name is empty for
+// clients that have not picked one.
+type UserInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Following bool   `json:"following"`
+}
+
+// setClientName stores name, which must have passed validateNickname, on
+// client.
+func setClientName(room *Room, client *Client, name string) {
+	room.mutex.Lock()
+	client.Name = strings.TrimSpace(name)
+	room.mutex.Unlock()
+}
+
+// broadcastUserList sends everyone in the room the list of who is present,
+// in the order they joined.
+func broadcastUserList(room *Room) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	clients := make([]*Client, 0, len(room.Clients))
+	for client := range room.Clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].joinedAt.Before(clients[j].joinedAt)
+	})
+	users := make([]UserInfo, len(clients))
+	followers := 0
+	for i, client := range clients {
+		users[i] = UserInfo{ID: client.ID, Name: client.Name, Following: !client.unfollowed}
+		if !client.unfollowed {
+			followers++
+		}
+	}
+	room.broadcastLocked(Message{
+		Type:      MessageUserList,
+		RoomID:    room.ID,
+		RoomName:  room.Name,
+		Count:     len(users),
+		Users:     users,
+		Followers: followers,
+	}, nil)
+}
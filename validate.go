@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Before a message reaches its handler, the fields its type needs are
+// checked here, so that a play without a usable time or an empty chat
+// message is answered with an error instead of being half applied and
+// relayed. Checks that depend on the room, such as whether a track index
+// exists, stay with the handlers.
+
+// messageValidator checks one inbound message's fields.
+type messageValidator func(msg *Message) error
+
+// messageValidators maps message types to their checks. Types without an
+// entry carry nothing that needs checking.
+var messageValidators = map[string]messageValidator{
+	MessagePlay:          validatePosition,
+	MessagePause:         validatePosition,
+	MessageSeek:          validatePosition,
+	MessageSeekingEnd:    validatePosition,
+	MessageSelectTrack:   validateTrackIndex,
+	MessagePlaybackEnded: validateTrackIndex,
+	MessageChat:          validateChat,
+	MessageJoin:          validateNickname,
+	MessageKick:          validateKick,
+	MessageVolume:        validateVolumeMessage,
+	MessageMute:          validateMuteMessage,
+	MessageRename:        validateRename,
+	MessagePingTime:      validatePingTime,
+	MessageSeekRelative:  validateSeekRelative,
+	MessageTransferHost:  validateTransferHost,
+}
+
+// validateMessage runs msg's checks, if its type has any.
+func validateMessage(msg *Message) error {
+	if validate, ok := messageValidators[msg.Type]; ok {
+		return validate(msg)
+	}
+	return nil
+}
+
+func validatePosition(msg *Message) error {
+	if msg.Time == nil {
+		return fmt.Errorf("%s needs a time", msg.Type)
+	}
+	if *msg.Time < 0 {
+		return fmt.Errorf("%s needs a time of 0 or more, got %g", msg.Type, *msg.Time)
+	}
+	return nil
+}
+
+func validateTrackIndex(msg *Message) error {
+	if msg.Track < 0 {
+		return fmt.Errorf("%s needs a track of 0 or more, got %d", msg.Type, msg.Track)
+	}
+	return nil
+}
+
+func validateChat(msg *Message) error {
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		return errors.New("chat message is empty")
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return fmt.Errorf("chat message is longer than %d characters", maxChatLength)
+	}
+	return nil
+}
+
+func validateNickname(msg *Message) error {
+	name := strings.TrimSpace(msg.Name)
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+	return nil
+}
+
+func validateKick(msg *Message) error {
+	if msg.ClientID == "" {
+		return errors.New("kick needs the clientId to kick")
+	}
+	return nil
+}
+
+func validateTransferHost(msg *Message) error {
+	if msg.ClientID == "" {
+		return errors.New("transfer_host needs the clientId of the new host")
+	}
+	return nil
+}
+
+func validatePingTime(msg *Message) error {
+	if msg.ClientTime <= 0 {
+		return errors.New("ping_time needs the sender's clientTime")
+	}
+	return nil
+}
+
+func validateVolumeMessage(msg *Message) error {
+	if msg.Volume == nil {
+		return errors.New("volume message needs a volume")
+	}
+	return validateVolume(*msg.Volume)
+}
+
+func validateMuteMessage(msg *Message) error {
+	if msg.Muted == nil {
+		return errors.New("mute message needs muted")
+	}
+	return nil
+}
+
+func validateRename(msg *Message) error {
+	_, err := cleanRoomName(msg.Name)
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMessage(t *testing.T) {
+	volume := func(v float64) *float64 { return &v }
+	muted := true
+	tests := []struct {
+		name  string
+		msg   Message
+		valid bool
+	}{
+		{"play at 0", Message{Type: MessagePlay, Time: at(0)}, true},
+		{"play without a time", Message{Type: MessagePlay}, false},
+		{"seek without a time", Message{Type: MessageSeek}, false},
+		{"play at a time", Message{Type: MessagePlay, Time: at(12.5)}, true},
+		{"play before the start", Message{Type: MessagePlay, Time: at(-1)}, false},
+		{"pause before the start", Message{Type: MessagePause, Time: at(-0.5)}, false},
+		{"seek before the start", Message{Type: MessageSeek, Time: at(-3)}, false},
+		{"seeking_end before the start", Message{Type: MessageSeekingEnd, Time: at(-3)}, false},
+		{"select a track", Message{Type: MessageSelectTrack, Track: 2}, true},
+		{"select a negative track", Message{Type: MessageSelectTrack, Track: -1}, false},
+		{"end a negative track", Message{Type: MessagePlaybackEnded, Track: -1}, false},
+		{"chat", Message{Type: MessageChat, Text: "hello"}, true},
+		{"empty chat", Message{Type: MessageChat, Text: "   "}, false},
+		{"chat at the limit", Message{Type: MessageChat, Text: strings.Repeat("é", maxChatLength)}, true},
+		{"chat past the limit", Message{Type: MessageChat, Text: strings.Repeat("é", maxChatLength+1)}, false},
+		{"join", Message{Type: MessageJoin, Name: "Ana"}, true},
+		{"join without a name", Message{Type: MessageJoin}, false},
+		{"join with a long name", Message{Type: MessageJoin, Name: strings.Repeat("a", maxNameLength+1)}, false},
+		{"kick", Message{Type: MessageKick, ClientID: "abc"}, true},
+		{"kick nobody", Message{Type: MessageKick}, false},
+		{"transfer_host nowhere", Message{Type: MessageTransferHost}, false},
+		{"volume", Message{Type: MessageVolume, Volume: volume(0.5)}, true},
+		{"volume missing", Message{Type: MessageVolume}, false},
+		{"volume below 0", Message{Type: MessageVolume, Volume: volume(-0.1)}, false},
+		{"volume above 1", Message{Type: MessageVolume, Volume: volume(1.5)}, false},
+		{"mute", Message{Type: MessageMute, Muted: &muted}, true},
+		{"mute missing", Message{Type: MessageMute}, false},
+		{"ping_time", Message{Type: MessagePingTime, ClientTime: 1}, true},
+		{"ping_time without clientTime", Message{Type: MessagePingTime}, false},
+		{"seek_relative", Message{Type: MessageSeekRelative, Delta: -10}, true},
+		{"seek_relative by nothing", Message{Type: MessageSeekRelative}, false},
+		{"rename past the limit", Message{Type: MessageRename, Name: strings.Repeat("a", maxRoomNameLength+1)}, false},
+		{"type without checks", Message{Type: MessageSeekingStart, Time: at(-1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMessage(&tt.msg)
+			if tt.valid && err != nil {
+				t.Errorf("validateMessage(%+v) = %v, want nil", tt.msg, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("validateMessage(%+v) = nil, want an error", tt.msg)
+			}
+		})
+	}
+}
+
+func TestInvalidMessageIsNotRelayed(t *testing.T) {
+	h := newTestHub(t)
+	srv := newTestServer(t, h)
+	roomID := "00000000000000b3"
+
+	host := dialRoom(t, srv, roomID)
+	host.expectCount(1)
+	listener := dialRoom(t, srv, roomID)
+	listener.expectCount(2)
+
+	host.send(Message{Type: MessageSeek, Time: at(-5)})
+	if got := host.expect(MessageError); !strings.Contains(got.Error, "time of 0 or more") {
+		t.Errorf("error = %q, want the time check", got.Error)
+	}
+	listener.expectNone(MessageSeek, 300*time.Millisecond)
+}
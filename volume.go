@@ -0,0 +1,49 @@
+package main
+
+import "fmt"
+
+// Besides playback, the host can set the room's volume and mute everyone.
+// Both are kept in the room's state, so late joiners get them in sync_state,
+// but they are not playback state and do not bump its Seq. Listeners apply
+// them as they arrive and stay free to change their own volume afterwards;
+// only what the host sends reaches the room.
+
+// defaultVolume is the volume a room starts at.
+const defaultVolume = 1.0
+
+// validateVolume checks that level is within 0.0–1.0.
+func validateVolume(level float64) error {
+	if level < 0 || level > 1 {
+		return fmt.Errorf("volume must be between 0 and 1, got %g", level)
+	}
+	return nil
+}
+
+// handleVolume sets the room's volume and relays it.
+func handleVolume(room *Room, sender *Client, msg *Message) error {
+	room.mutex.Lock()
+	room.Volume = *msg.Volume
+	room.mutex.Unlock()
+	persistRoom(room)
+	relay(room, sender, msg)
+	return nil
+}
+
+// handleMute mutes or unmutes the room and relays it.
+func handleMute(room *Room, sender *Client, msg *Message) error {
+	room.mutex.Lock()
+	room.Muted = *msg.Muted
+	room.mutex.Unlock()
+	persistRoom(room)
+	relay(room, sender, msg)
+	return nil
+}
+
+// restoredVolume is the volume to restore a room with from its saved
+// state, which predates volumes if it has none.
+func restoredVolume(state RoomState) float64 {
+	if state.Volume == nil {
+		return defaultVolume
+	}
+	return *state.Volume
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The waveform image draws a track's peaks as a PNG, for embeds that want a
+// picture rather than the JSON. Each column of the image covers a run of
+// peak buckets and is filled from the highest to the lowest sample in it,
+// on a transparent background. Rendered images are kept in memory, keyed by
+// track and parameters, up to waveformCacheSize of them.
+
+const (
+	defaultWaveformWidth  = 800
+	defaultWaveformHeight = 100
+	maxWaveformWidth      = 4000
+	maxWaveformHeight     = 1000
+	// defaultWaveformColor matches the pages' accent colour.
+	defaultWaveformColor = "667eea"
+	// waveformCacheSize is how many rendered images are kept.
+	waveformCacheSize = 256
+)
+
+type waveformKey struct {
+	track         string
+	width, height int
+	color         color.NRGBA
+}
+
+// waveformCache holds rendered images, dropping the oldest once full.
+var waveformCache = struct {
+	sync.Mutex
+	images map[waveformKey][]byte
+	order  []waveformKey
+}{images: make(map[waveformKey][]byte)}
+
+func (s *Server) handleWaveform(c *gin.Context) {
+	roomID := c.Param("id")
+	if !validateRoomID(roomID) {
+		respondError(c, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+	if !s.requireJoinToken(c, roomID) {
+		return
+	}
+
+	index, err := strconv.Atoi(c.DefaultQuery("track", "0"))
+	if err != nil || index < 0 {
+		respondError(c, http.StatusBadRequest, "Invalid track index")
+		return
+	}
+	width, err := strconv.Atoi(c.DefaultQuery("width", strconv.Itoa(defaultWaveformWidth)))
+	if err != nil || width < 1 || width > maxWaveformWidth {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("width must be between 1 and %d", maxWaveformWidth))
+		return
+	}
+	height, err := strconv.Atoi(c.DefaultQuery("height", strconv.Itoa(defaultWaveformHeight)))
+	if err != nil || height < 1 || height > maxWaveformHeight {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("height must be between 1 and %d", maxWaveformHeight))
+		return
+	}
+	fill, err := parseHexColor(c.DefaultQuery("color", defaultWaveformColor))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name, ok := s.hub.findTrackAudio(roomID, index)
+	if !ok {
+		respondError(c, http.StatusNotFound, "Audio file not found")
+		return
+	}
+
+	key := waveformKey{track: name, width: width, height: height, color: fill}
+	img, ok := cachedWaveform(key)
+	if !ok {
+		peaks, err := s.hub.loadPeaks(name)
+		if errors.Is(err, errPeaksUnsupported) {
+			respondError(c, http.StatusNotImplemented, "Waveforms are only available for MP3 and WAV tracks")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to compute peaks", "roomId", roomID, "track", name, "error", err)
+			respondError(c, http.StatusInternalServerError, "Failed to decode audio")
+			return
+		}
+		img, err = renderWaveform(peaks, width, height, fill)
+		if err != nil {
+			slog.Error("Failed to render waveform", "roomId", roomID, "track", name, "error", err)
+			respondError(c, http.StatusInternalServerError, "Failed to render waveform")
+			return
+		}
+		cacheWaveform(key, img)
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, "image/png", img)
+}
+
+// parseHexColor parses an opaque colour written as RRGGBB, with or without
+// a leading #.
+func parseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	v, err := strconv.ParseUint(s, 16, 32)
+	if len(s) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("color must be six hex digits, like %s", defaultWaveformColor)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// renderWaveform draws peaks into a width by height PNG.
+func renderWaveform(peaks Peaks, width, height int, fill color.NRGBA) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	points := len(peaks.Max)
+	if len(peaks.Min) < points {
+		points = len(peaks.Min)
+	}
+
+	// y maps a sample in [-1, 1] to a row, +1 at the top.
+	y := func(v float32) int {
+		row := int((1 - float64(v)) / 2 * float64(height-1))
+		return max(0, min(height-1, row))
+	}
+	for x := 0; x < width && points > 0; x++ {
+		first := x * points / width
+		last := max(first+1, (x+1)*points/width)
+		lo, hi := peaks.Min[first], peaks.Max[first]
+		for i := first + 1; i < last; i++ {
+			lo = min(lo, peaks.Min[i])
+			hi = max(hi, peaks.Max[i])
+		}
+		for row := y(hi); row <= y(lo); row++ {
+			img.SetNRGBA(x, row, fill)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func cachedWaveform(key waveformKey) ([]byte, bool) {
+	waveformCache.Lock()
+	defer waveformCache.Unlock()
+	img, ok := waveformCache.images[key]
+	return img, ok
+}
+
+func cacheWaveform(key waveformKey, img []byte) {
+	waveformCache.Lock()
+	defer waveformCache.Unlock()
+	if _, ok := waveformCache.images[key]; ok {
+		return
+	}
+	if len(waveformCache.order) >= waveformCacheSize {
+		delete(waveformCache.images, waveformCache.order[0])
+		waveformCache.order = waveformCache.order[1:]
+	}
+	waveformCache.images[key] = img
+	waveformCache.order = append(waveformCache.order, key)
+}
@@ -0,0 +1,33 @@
+package main
+
+// A client's first message on every connection, whether it has just joined
+// or resumed its session, is a welcome. It carries what the client would
+// otherwise fetch over HTTP before it could show the room: its own ID,
+// whether it is host, how many clients the room has and can take, the
+// room's name, whether it has any audio or plays the placeholder instead,
+// and the playback state as a sync_state. The messages that used to open
+// the connection still follow it, sync_state included, and later changes
+// arrive as they always have, so a client that ignores welcome misses
+// nothing.
+
+// sendWelcome sends client its welcome.
+func sendWelcome(room *Room, client *Client) {
+	room.mutex.RLock()
+	state := syncStateMessage(room, client)
+	msg := Message{
+		Type:        MessageWelcome,
+		RoomID:      room.ID,
+		RoomName:    room.Name,
+		ClientID:    client.ID,
+		IsHost:      room.Host == client,
+		UserCount:   len(room.Clients),
+		Capacity:    room.hub.config.MaxClientsPerRoom,
+		HasAudio:    len(room.Playlist) > 0,
+		Placeholder: len(room.Playlist) == 0 && room.hub.config.PlaceholderAudio != "",
+		Protocol:    client.conn.Subprotocol(),
+		SyncState:   &state,
+	}
+	room.mutex.RUnlock()
+
+	client.Send(msg)
+}